@@ -4,9 +4,15 @@ go 1.23.4
 
 require (
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/securecookie v1.1.2
 	github.com/gorilla/sessions v1.4.0
+	github.com/hexops/gotextdiff v1.0.3
 	github.com/mattn/go-sqlite3 v1.14.28
 	golang.org/x/crypto v0.37.0
+	golang.org/x/image v0.25.0
 )
 
-require github.com/gorilla/securecookie v1.1.2 // indirect
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.24.0 // indirect
+)
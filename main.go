@@ -1,44 +1,102 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
-	_ "github.com/mattn/go-sqlite3" // SQLite driver
+	"github.com/hexops/gotextdiff"
+	"github.com/hexops/gotextdiff/myers"
+	"github.com/hexops/gotextdiff/span"
+	"github.com/mattn/go-sqlite3" // SQLite driver
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/crypto/bcrypt"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
 )
 
 const (
-	dbFileName         = "db/underlog.db"
-	sessionKeyName     = "underlog-session"
-	sessionSecret      = "replace-this-with-a-real-secret-key" // TODO: Use env var or config file
-	staticDir          = "./static"
-	userIDContextKey   = "userID" // Key for storing user ID in request context
-	defaultProjectName = "Untitled Project"
-	pdfTempDirPrefix   = "underlog-pdf-"
+	dbFileName           = "db/underlog.db"
+	sessionKeyName       = "underlog-session"
+	defaultSessionSecret = "replace-this-with-a-real-secret-key" // Used when UNDERLOG_SESSION_SECRETS is unset
+	defaultStaticDir     = "./static"
+	userIDContextKey     = "userID"   // Key for storing user ID in request context
+	clientIPContextKey   = "clientIP" // Key for storing the resolved client IP in request context
+	defaultProjectName   = "Untitled Project"
+	svgContentType       = "image/svg+xml" // Default project body content type
+	markdownContentType  = "text/markdown"
+	pdfTempDirPrefix     = "underlog-pdf-"
+	pdfCacheDirName      = "underlog-pdf-cache"
+	uploadTempPrefix     = "underlog-upload-"
+
+	defaultMaxImagesPerProject = 500 // Overridden by UNDERLOG_MAX_IMAGES_PER_PROJECT
+
+	// Size limit of chunked uploads when UNDERLOG_MAX_IMAGE_BYTES is 0; the assembled temp file is read into memory
+	maxChunkedUploadBytes = 1 << 30
+
+	// Body of new projects created without one, unless UNDERLOG_DEFAULT_TEMPLATE names a file
+	builtinBodyTemplate = "# Title\n\nStart writing here.\n"
 )
 
 var (
 	db           *sql.DB
-	sessionStore *sessions.CookieStore
+	sessionStore sessions.Store
 	dbMutex      sync.Mutex // To protect DB operations if needed, though database/sql handles pooling
 )
 
+// version identifies the build in the API landing response; set with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
 // --- Structs for JSON API ---
 
 type RegisterRequest struct {
@@ -52,43 +110,451 @@ type LoginRequest struct {
 }
 
 type ProjectListItem struct {
-	ID   int64  `json:"id"`
-	Name string `json:"name"`
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Archived bool   `json:"archived"`
 }
 
 type ProjectDetail struct {
-	ID         int64    `json:"id"`
-	Name       string   `json:"name"`
-	Body       string   `json:"body"`
-	ImageNames []string `json:"image_names"`
+	ID          int64              `json:"id"`
+	Name        string             `json:"name"`
+	ContentType string             `json:"content_type"` // Format of the body, see projectContentTypes
+	Body        string             `json:"body"`
+	ImageNames  []string           `json:"image_names"`
+	ImageURLs   map[string]string  `json:"image_urls,omitempty"` // Externally hosted images by name
+	Images      []ProjectImageData `json:"images,omitempty"`     // Only with ?include=images
+}
+
+// ProjectImageData embeds one image in a project response
+type ProjectImageData struct {
+	Name       string `json:"name"`
+	BlobBase64 string `json:"blob_base64,omitempty"`
+	Gzip       bool   `json:"gzip,omitempty"` // blob_base64 holds the gzip-compressed bytes
+	URL        string `json:"url,omitempty"`  // Externally hosted image, no blob
 }
 
 type CreateProjectRequest struct {
-	Name string `json:"name"`
-	Body string `json:"body"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"` // Defaults to image/svg+xml
+	Body        string `json:"body"`
 }
 
 type UpdateProjectRequest struct {
-	Name   string               `json:"name"`
-	Body   string               `json:"body"`
-	Images []ProjectUpdateImage `json:"images"` // Client sends all images for the project
+	Name        string               `json:"name"`
+	ContentType string               `json:"content_type,omitempty"` // Unchanged when empty
+	Body        string               `json:"body"`
+	BodyPatch   *BodyPatch           `json:"body_patch,omitempty"` // Sent instead of body to edit the stored body
+	Images      []ProjectUpdateImage `json:"images"`               // Client sends all images for the project
+}
+
+// BodyPatch edits the stored body instead of replacing it. BaseHash is the hex SHA-256 of the
+// body the ops were made against; a sync whose base is no longer current is rejected with 409.
+type BodyPatch struct {
+	BaseHash string        `json:"base_hash"`
+	Ops      []BodyPatchOp `json:"ops"`
+}
+
+// BodyPatchOp replaces Delete bytes at byte Offset of the base body with Insert.
+// Ops must be sorted by offset and must not overlap.
+type BodyPatchOp struct {
+	Offset int    `json:"offset"`
+	Delete int    `json:"delete"`
+	Insert string `json:"insert"`
 }
 
 type ProjectUpdateImage struct {
 	Name       string `json:"name"`
 	BlobBase64 string `json:"blob_base64,omitempty"` // Base64 encoded blob for new/updated images
+	URL        string `json:"url,omitempty"`         // Externally hosted image, sent instead of blob_base64
+}
+
+// SyncSummary describes the changes a sync would apply (returned for ?dry_run=true)
+type SyncSummary struct {
+	NameChanged bool     `json:"name_changed"`
+	BodyChanged bool     `json:"body_changed"`
+	Added       []string `json:"added"`
+	Deleted     []string `json:"deleted"`
+	Updated     []string `json:"updated"`
+}
+
+// ImageMetadata describes one image in the image listing
+type ImageMetadata struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	URL         string    `json:"url,omitempty"` // Set for externally hosted images, whose size is 0
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DownloadImagesRequest selects the images of a zip download; all images when Names is omitted
+type DownloadImagesRequest struct {
+	Names []string `json:"names"`
+}
+
+// ImageList is one page of a project's images
+type ImageList struct {
+	Images     []ImageMetadata `json:"images"`
+	Total      int             `json:"total"`       // Images in the project, not just this page
+	TotalBytes int64           `json:"total_bytes"` // Size of all images in the project, not just this page
+}
+
+// DuplicateImageGroup lists image names within a project that share the same content hash
+type DuplicateImageGroup struct {
+	Hash  string   `json:"hash"`
+	Size  int64    `json:"size"`
+	Names []string `json:"names"`
 }
 
 // PDFRequest struct for decoding the incoming JSON for PDF generation
 type PDFRequest struct {
-	Input string `json:"input"` // Expects SVG content here
+	Input string `json:"input"`          // Expects SVG content here
+	Page  int    `json:"page,omitempty"` // Render only this 1-based page; 0 renders the whole document
+}
+
+// --- Configuration ---
+
+// Config holds runtime settings, overridable through UNDERLOG_* environment variables
+type Config struct {
+	MaxBodyBytes  int // Maximum project body length in bytes, 0 disables the check
+	MaxImages     int // Maximum images per project, 0 disables the check
+	MaxImageBytes int // Maximum size of one image in bytes, 0 disables the check
+	MaxPDFPages   int // Maximum <svg> pages accepted by /pdf, 0 disables the check
+
+	MaxUploadChunkBytes int64         // Maximum size of one chunk of a chunked image upload
+	UploadExpiry        time.Duration // Chunked uploads without a new chunk for this long are discarded
+
+	PDFRateLimit     int   // Requests per minute per client IP to /pdf and /odt, 0 disables the limit
+	PDFMaxInputBytes int64 // Maximum request body size of /pdf and /odt, 0 disables the check
+	UserWriteLimit   int   // Project and image writes per minute per user, 0 disables the limit
+	UserPDFLimit     int   // Renders per minute per user, /pdf and /odt included when logged in, 0 disables the limit
+
+	RenderCommand string // Shell command rendering a stored project to SVG for /api/projects/{id}/pdf; empty disables it
+	// MarkdownPDFCommand turns body.md (images in images/) into output.pdf for text/markdown
+	// projects, e.g. "pandoc body.md -f markdown-raw_html -t html5 --pdf-engine=weasyprint -o output.pdf";
+	// empty disables it. Bodies are user input: weasyprint fetches every URL it meets, file:// included,
+	// so keep raw HTML disabled as above, or run it with a url_fetcher limited to images/
+	MarkdownPDFCommand string
+
+	CaseInsensitiveNames bool          // Reject image and project names that differ from existing ones only in case
+	RequireProjectName   bool          // Reject blank project names instead of using defaultProjectName
+	PDFCacheTTL          time.Duration // How long an unused generated PDF stays cached
+	PDFTempMaxAge        time.Duration // PDF work directories left behind by a crash are removed after this long
+	RequireStatic        bool          // Exit at startup if the static directory or index.html is missing
+	StaticDir            string        // Directory the web client is served from
+	SPAFallback          bool          // Serve index.html for unknown client-side routes such as /projects/5
+	BasePath             string        // Path prefix the app is mounted under behind a proxy, e.g. /underlog; empty for /
+
+	MaxProjectNameLength int    // Maximum project name length in characters, 0 disables the check
+	DefaultTemplate      string // File new projects created without a body start from; empty uses the built-in template
+
+	TLSCertFile  string // Serve HTTPS with this certificate; the server refuses to start with only one of the two set
+	TLSKeyFile   string
+	Domain       string // Obtain certificates for this domain from Let's Encrypt
+	ACMECacheDir string // Where Let's Encrypt certificates are cached
+
+	TrustedProxies []*net.IPNet  // Proxies whose X-Forwarded-For/X-Real-IP headers are believed
+	CORSOrigins    []string      // Browser origins allowed to call the server cross-origin; "*" allows any, without cookies
+	CORSMaxAge     time.Duration // How long browsers may cache a preflight result, 0 omits Access-Control-Max-Age
+	AdminUsers     []string      // Usernames allowed to use /api/admin routes
+
+	WebhookAllowPrivate bool // Deliver webhooks to loopback, private and link-local addresses
+
+	MaxImportBytes        int64 // Maximum size of an uploaded account import archive
+	MaxEmbeddedImageBytes int64 // Maximum stored image bytes returned by ?include=images, 0 disables the check
+	UserQuotaBytes        int64 // Maximum bytes of bodies and images per user, 0 disables the quota
+
+	SessionMaxAge      time.Duration // Absolute session lifetime from login
+	SessionIdleTimeout time.Duration // Session expires after this long without requests, 0 disables
+	SessionBackend     string        // Where session values live: "cookie", "filesystem" or "sqlite"
+	SessionDir         string        // Directory of the filesystem session store
+	SessionSameSite    http.SameSite // SameSite attribute of the session cookie; None needs TLS
+	// SessionSecrets sign session cookies and embed tokens. The first signs new ones; later ones only
+	// validate existing ones, so a key is rotated by prepending the new secret and dropping the old one
+	// once sessions signed with it have expired (UNDERLOG_SESSION_MAX_AGE).
+	SessionSecrets []string
+
+	MaxImageNameLength int            // Maximum image name length in characters, 0 disables the check
+	ImageNamePattern   *regexp.Regexp // Optional allowlist pattern image names must match
+
+	ProjectCacheSize int // Number of project detail responses kept in memory, 0 disables the cache
+
+	VersionRetention int // Body snapshots kept per project, 0 disables version history
+
+	EncryptionKey string // Hex or base64 AES key project bodies are encrypted with at rest; empty stores plaintext
+
+	ImageStorage string // Where image bytes are kept: "sqlite" or "filesystem"
+	ImageDir     string // Directory of the filesystem image store
+
+	BcryptCost int // bcrypt work factor for new password hashes; older hashes are upgraded on login
+
+	RequestTimeout    time.Duration // How long a handler may work on a request, 0 disables the limit
+	PDFRequestTimeout time.Duration // Longer limit for /pdf (external PDF tools), account imports and VACUUM
+
+	DBBusyTimeout      time.Duration // How long SQLite waits for another connection's lock before SQLITE_BUSY
+	WALCheckpointEvery time.Duration // Interval of PRAGMA wal_checkpoint(TRUNCATE), 0 disables the schedule
+
+	ReadHeaderTimeout time.Duration // Time allowed to read request headers
+	ReadTimeout       time.Duration // Time allowed to read a whole request; long-running routes get PDFRequestTimeout on top
+	WriteTimeout      time.Duration // Time allowed to write a response; long-running routes get PDFRequestTimeout on top
+	IdleTimeout       time.Duration // How long keep-alive connections wait for the next request
+	ShutdownTimeout   time.Duration // How long in-flight requests may finish after SIGINT/SIGTERM
+
+	LogLevel slog.Level // Minimum level written to the log; request lines are logged at info
+}
+
+var cfg Config
+
+func loadConfig() Config {
+	return Config{
+		MaxBodyBytes:  envInt("UNDERLOG_MAX_BODY_BYTES", 5<<20),
+		MaxImages:     envInt("UNDERLOG_MAX_IMAGES_PER_PROJECT", defaultMaxImagesPerProject),
+		MaxImageBytes: envInt("UNDERLOG_MAX_IMAGE_BYTES", 50<<20),
+		MaxPDFPages:   envInt("UNDERLOG_MAX_PDF_PAGES", 1000),
+
+		MaxUploadChunkBytes: int64(envInt("UNDERLOG_MAX_UPLOAD_CHUNK_BYTES", 8<<20)),
+		UploadExpiry:        envDuration("UNDERLOG_UPLOAD_EXPIRY", 24*time.Hour),
+
+		PDFRateLimit:     envInt("UNDERLOG_PDF_RATE_LIMIT", 30),
+		PDFMaxInputBytes: int64(envInt("UNDERLOG_PDF_MAX_INPUT_BYTES", 20<<20)),
+		UserWriteLimit:   envInt("UNDERLOG_USER_WRITE_RATE_LIMIT", 120),
+		UserPDFLimit:     envInt("UNDERLOG_USER_PDF_RATE_LIMIT", 10),
+
+		RenderCommand:      os.Getenv("UNDERLOG_RENDER_COMMAND"),
+		MarkdownPDFCommand: os.Getenv("UNDERLOG_MARKDOWN_PDF_COMMAND"),
+
+		CaseInsensitiveNames: envBool("UNDERLOG_CASE_INSENSITIVE_NAMES", false),
+		RequireProjectName:   envBool("UNDERLOG_REQUIRE_PROJECT_NAME", false),
+		PDFCacheTTL:          envDuration("UNDERLOG_PDF_CACHE_TTL", time.Hour),
+		PDFTempMaxAge:        envDuration("UNDERLOG_PDF_TEMP_MAX_AGE", time.Hour),
+		RequireStatic:        envBool("UNDERLOG_REQUIRE_STATIC", false),
+		StaticDir:            envString("UNDERLOG_STATIC_DIR", defaultStaticDir),
+		SPAFallback:          envBool("UNDERLOG_SPA_FALLBACK", true),
+		BasePath:             normalizeBasePath(os.Getenv("UNDERLOG_BASE_PATH")),
+
+		MaxProjectNameLength: envInt("UNDERLOG_MAX_PROJECT_NAME_LENGTH", 200),
+		DefaultTemplate:      os.Getenv("UNDERLOG_DEFAULT_TEMPLATE"),
+
+		TLSCertFile:  os.Getenv("UNDERLOG_TLS_CERT"),
+		TLSKeyFile:   os.Getenv("UNDERLOG_TLS_KEY"),
+		Domain:       os.Getenv("UNDERLOG_DOMAIN"),
+		ACMECacheDir: envString("UNDERLOG_ACME_CACHE_DIR", "db/autocert"),
+
+		TrustedProxies: parseTrustedProxies(os.Getenv("UNDERLOG_TRUSTED_PROXIES")),
+		CORSOrigins:    parseCORSOrigins(envList("UNDERLOG_CORS_ORIGINS")),
+		CORSMaxAge:     envDuration("UNDERLOG_CORS_MAX_AGE", 10*time.Minute),
+		AdminUsers:     envList("UNDERLOG_ADMIN_USERS"),
+
+		WebhookAllowPrivate: envBool("UNDERLOG_WEBHOOK_ALLOW_PRIVATE", false),
+
+		MaxImportBytes:        int64(envInt("UNDERLOG_MAX_IMPORT_BYTES", 1<<30)),
+		MaxEmbeddedImageBytes: int64(envInt("UNDERLOG_MAX_EMBEDDED_IMAGE_BYTES", 64<<20)),
+		UserQuotaBytes:        int64(envInt("UNDERLOG_USER_QUOTA_BYTES", 0)),
+
+		SessionMaxAge:      envDuration("UNDERLOG_SESSION_MAX_AGE", 24*time.Hour),
+		SessionIdleTimeout: envDuration("UNDERLOG_SESSION_IDLE_TIMEOUT", 2*time.Hour),
+		SessionBackend:     envString("UNDERLOG_SESSION_BACKEND", "cookie"),
+		SessionDir:         envString("UNDERLOG_SESSION_DIR", "db/sessions"),
+		SessionSameSite:    envSameSite("UNDERLOG_SESSION_SAMESITE", http.SameSiteLaxMode),
+		SessionSecrets:     envSessionSecrets("UNDERLOG_SESSION_SECRETS"),
+
+		MaxImageNameLength: envInt("UNDERLOG_MAX_IMAGE_NAME_LENGTH", 255),
+		ImageNamePattern:   envRegexp("UNDERLOG_IMAGE_NAME_PATTERN"),
+
+		ProjectCacheSize: envInt("UNDERLOG_PROJECT_CACHE_SIZE", 128),
+
+		VersionRetention: envInt("UNDERLOG_VERSION_RETENTION", 50),
+
+		EncryptionKey: os.Getenv("UNDERLOG_ENCRYPTION_KEY"),
+
+		ImageStorage: envString("UNDERLOG_IMAGE_STORAGE", "sqlite"),
+		ImageDir:     envString("UNDERLOG_IMAGE_DIR", "db/images"),
+
+		BcryptCost: envIntInRange("UNDERLOG_BCRYPT_COST", bcrypt.DefaultCost, bcrypt.MinCost, bcrypt.MaxCost),
+
+		RequestTimeout:    envDuration("UNDERLOG_REQUEST_TIMEOUT", 30*time.Second),
+		PDFRequestTimeout: envDuration("UNDERLOG_PDF_REQUEST_TIMEOUT", 5*time.Minute),
+
+		DBBusyTimeout:      envDuration("UNDERLOG_DB_BUSY_TIMEOUT", defaultDBBusyTimeout),
+		WALCheckpointEvery: envDuration("UNDERLOG_WAL_CHECKPOINT_INTERVAL", 5*time.Minute),
+
+		ReadHeaderTimeout: envDuration("UNDERLOG_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("UNDERLOG_READ_TIMEOUT", time.Minute),
+		WriteTimeout:      envDuration("UNDERLOG_WRITE_TIMEOUT", time.Minute),
+		IdleTimeout:       envDuration("UNDERLOG_IDLE_TIMEOUT", 2*time.Minute),
+		ShutdownTimeout:   envDuration("UNDERLOG_SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		LogLevel: envLogLevel("UNDERLOG_LOG_LEVEL", slog.LevelInfo),
+	}
+}
+
+// envString reads a string environment variable, falling back to def when unset
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envList reads a comma-separated environment variable, dropping empty entries
+func envList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envSessionSecrets reads the comma-separated session secrets, current secret first, falling back
+// to defaultSessionSecret
+func envSessionSecrets(name string) []string {
+	if secrets := envList(name); len(secrets) > 0 {
+		return secrets
+	}
+	return []string{defaultSessionSecret}
+}
+
+// envRegexp compiles a regular expression environment variable, returning nil when unset or invalid
+func envRegexp(name string) *regexp.Regexp {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		logWarnf("Ignoring invalid %s=%q: %v", name, value, err)
+		return nil
+	}
+	return re
+}
+
+// envInt reads an integer environment variable, falling back to def when unset or invalid
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		logWarnf("Ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+	return n
+}
+
+// envIntInRange reads an integer environment variable, falling back to def when it is outside [min, max]
+func envIntInRange(name string, def, min, max int) int {
+	n := envInt(name, def)
+	if n < min || n > max {
+		logWarnf("Ignoring %s=%d, expected %d-%d", name, n, min, max)
+		return def
+	}
+	return n
+}
+
+// envSameSite reads a cookie SameSite mode ("lax", "strict" or "none"), falling back to def when unset or invalid
+func envSameSite(name string, def http.SameSite) http.SameSite {
+	switch value := strings.ToLower(os.Getenv(name)); value {
+	case "":
+		return def
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		logWarnf("Ignoring invalid %s=%q, expected lax, strict or none", name, value)
+		return def
+	}
+}
+
+// envBool reads a boolean environment variable such as "true" or "0"
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		logWarnf("Ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+	return b
+}
+
+// normalizeBasePath turns a configured base path into "/prefix" form without a trailing slash; "" and "/" mean the root
+func normalizeBasePath(value string) string {
+	value = strings.Trim(strings.TrimSpace(value), "/")
+	if value == "" {
+		return ""
+	}
+	return "/" + value
+}
+
+// envLogLevel reads a log level ("debug", "info", "warn" or "error"), falling back to def when unset or invalid
+func envLogLevel(name string, def slog.Level) slog.Level {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		logWarnf("Ignoring invalid %s=%q, expected debug, info, warn or error", name, value)
+		return def
+	}
+	return level
+}
+
+// envDuration reads a duration environment variable such as "30s" or "1h"
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logWarnf("Ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+	return d
+}
+
+// --- Logging ---
+
+// logAt formats and emits a message at the given level, skipping the formatting when the level is disabled.
+// Plain log.Printf calls still go through the default slog handler at info level.
+func logAt(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+	slog.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+// logDebugf logs per-request detail that is only useful when tracing a problem
+func logDebugf(format string, args ...any) { logAt(slog.LevelDebug, format, args...) }
+
+// logWarnf logs a recoverable problem or suspicious request
+func logWarnf(format string, args ...any) { logAt(slog.LevelWarn, format, args...) }
+
+// logErrorf logs a failure that made a request or background job fail
+func logErrorf(format string, args ...any) { logAt(slog.LevelError, format, args...) }
+
+// logFatalf logs an error regardless of the configured level and exits
+func logFatalf(format string, args ...any) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
 }
 
 // --- Database Initialization ---
 
 func initDB(filename string) (*sql.DB, error) {
 	log.Printf("Initializing database: %s", filename)
-	database, err := sql.Open("sqlite3", filename+"?_foreign_keys=on") // Enable foreign key constraints
+	// Enable foreign key constraints, and let SQLite wait for locks held by other connections before returning SQLITE_BUSY.
+	// WAL lets readers on other connections (image store, backups) proceed while a write is in progress.
+	database, err := sql.Open("sqlite3", fmt.Sprintf("%s?_foreign_keys=on&_busy_timeout=%d&_journal_mode=WAL", filename, cfg.DBBusyTimeout.Milliseconds()))
 	if err != nil {
 		return nil, err
 	}
@@ -129,6 +595,52 @@ CREATE TABLE IF NOT EXISTS images (
 	FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
 	UNIQUE(project_id, name)
 );
+
+CREATE TABLE IF NOT EXISTS project_versions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	project_id INTEGER NOT NULL,
+	version INTEGER NOT NULL,
+	body TEXT NOT NULL, -- Full body, or the differing middle when base_version is set
+	base_version INTEGER, -- Full snapshot this delta applies to, NULL for full snapshots
+	prefix_len INTEGER NOT NULL DEFAULT 0, -- Bytes taken from the start of the base body
+	suffix_len INTEGER NOT NULL DEFAULT 0, -- Bytes taken from the end of the base body
+	image_names TEXT NOT NULL DEFAULT '[]', -- JSON array of image names at this version
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+	UNIQUE(project_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS image_blobs (
+	storage_key TEXT PRIMARY KEY, -- Content hash of the blob
+	blob BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER, -- NULL for anonymous requests
+	action TEXT NOT NULL,
+	target_id INTEGER,
+	ip TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_user_created ON audit_log(user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	data TEXT NOT NULL, -- Values encoded and signed with the session secret
+	expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events TEXT NOT NULL DEFAULT '', -- Comma-separated event names, empty means all
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
 	`
 
 	_, err = database.Exec(schema)
@@ -137,661 +649,7911 @@ CREATE TABLE IF NOT EXISTS images (
 		return nil, err
 	}
 
+	if err = migrateDB(database); err != nil {
+		database.Close()
+		return nil, err
+	}
+
 	log.Println("Database initialized successfully.")
 	return database, nil
 }
 
-// --- Password Hashing ---
-
-func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(bytes), err
-}
+// migrateDB applies schema changes that CREATE TABLE IF NOT EXISTS cannot express for existing databases
+func migrateDB(database *sql.DB) error {
+	if err := ensureColumn(database, "images", "content_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(database, "projects", "archived", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(database, "projects", "content_type", "TEXT NOT NULL DEFAULT '"+svgContentType+"'"); err != nil {
+		return err
+	}
+	if err := ensureColumn(database, "images", "storage_key", "TEXT"); err != nil { // NULL while the blob is still inline
+		return err
+	}
+	if err := ensureColumn(database, "images", "size", "INTEGER"); err != nil {
+		return err
+	}
+	if _, err := database.Exec("CREATE INDEX IF NOT EXISTS idx_images_project_hash ON images(project_id, content_hash)"); err != nil {
+		return err
+	}
+	if _, err := database.Exec("CREATE INDEX IF NOT EXISTS idx_images_storage_key ON images(storage_key)"); err != nil {
+		return err
+	}
+	// External images have a url instead of a storage_key. blob stays NOT NULL (X'' for every image
+	// since blobs moved to the image store), as SQLite can only relax constraints by rebuilding the
+	// table, so triggers stand in for a CHECK that exactly one of url and storage_key is set.
+	if err := ensureColumn(database, "images", "url", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := database.Exec(`
+CREATE TRIGGER IF NOT EXISTS images_url_or_storage_key_insert BEFORE INSERT ON images
+WHEN (NEW.url IS NULL) = (NEW.storage_key IS NULL)
+BEGIN
+	SELECT RAISE(ABORT, 'image must have exactly one of url and storage_key');
+END;
 
-func checkPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+CREATE TRIGGER IF NOT EXISTS images_url_or_storage_key_update BEFORE UPDATE OF url, storage_key ON images
+WHEN (NEW.url IS NULL) = (NEW.storage_key IS NULL)
+BEGIN
+	SELECT RAISE(ABORT, 'image must have exactly one of url and storage_key');
+END;`); err != nil {
+		return err
+	}
+	if _, err := database.Exec("UPDATE images SET size = length(blob) WHERE size IS NULL"); err != nil {
+		return err
+	}
+	// Usernames are case-insensitive; older databases may already hold case-only duplicates
+	if _, err := database.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_nocase ON users(username COLLATE NOCASE)"); err != nil {
+		logWarnf("Could not create case-insensitive username index (duplicate usernames?): %v", err)
+	}
+	return backfillImageHashes(database)
 }
 
-// --- Middleware ---
+// ensureColumn adds a column to a table if it does not exist yet
+func ensureColumn(database *sql.DB, table, column, definition string) error {
+	rows, err := database.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-func authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, err := sessionStore.Get(r, sessionKeyName)
-		if err != nil {
-			log.Printf("Auth middleware: Error getting session: %v", err)
-			http.Error(w, "Session error", http.StatusInternalServerError)
-			return
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			return err
 		}
-
-		userID, ok := session.Values[userIDContextKey].(int64)
-		if !ok || userID == 0 {
-			log.Printf("Auth middleware: Unauthorized access attempt to %s", r.URL.Path)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		if name == column {
+			return nil
 		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
 
-		// Add user ID to context for handlers to use
-		ctx := context.WithValue(r.Context(), userIDContextKey, userID)
-		log.Printf("Auth middleware: User %d authorized for %s", userID, r.URL.Path)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	log.Printf("Migrating database: adding column %s.%s", table, column)
+	_, err = database.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
-// --- Handlers ---
+// backfillImageHashes computes content hashes for images stored before hashing was introduced
+func backfillImageHashes(database *sql.DB) error {
+	rows, err := database.Query("SELECT id, blob FROM images WHERE content_hash IS NULL AND url IS NULL")
+	if err != nil {
+		return err
+	}
+	hashes := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var blob []byte
+		if err := rows.Scan(&id, &blob); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = contentHash(blob)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
 
-// POST /register
-func registerHandler(w http.ResponseWriter, r *http.Request) {
-	var req RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	if len(hashes) == 0 {
+		return nil
 	}
-	defer r.Body.Close()
+	log.Printf("Migrating database: computing content hashes for %d images", len(hashes))
+	for id, hash := range hashes {
+		if _, err := database.Exec("UPDATE images SET content_hash = ? WHERE id = ?", hash, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if req.Username == "" || req.Password == "" {
-		http.Error(w, "Username and password are required", http.StatusBadRequest)
+// contentHash returns the hex encoded SHA-256 of an image blob
+func contentHash(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpointWAL copies the write-ahead log into the database file and truncates it, so the -wal
+// file doesn't grow without bound. Outside WAL mode SQLite reports log = -1 and nothing happens.
+// The caller must hold dbMutex.
+func checkpointWAL() {
+	var busy, logFrames, checkpointed int
+	if err := db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		logErrorf("Error checkpointing WAL: %v", err)
 		return
 	}
+	switch {
+	case logFrames < 0:
+		logDebugf("WAL checkpoint skipped, database is not in WAL mode")
+	case busy != 0:
+		logWarnf("WAL checkpoint blocked by readers: %d of %d frames checkpointed", checkpointed, logFrames)
+	default:
+		log.Printf("WAL checkpoint complete: %d frames checkpointed", checkpointed)
+	}
+}
 
-	hashedPassword, err := hashPassword(req.Password)
-	if err != nil {
-		log.Printf("Error hashing password for %s: %v", req.Username, err)
-		http.Error(w, "Failed to process registration", http.StatusInternalServerError)
-		return
+// runWALCheckpoints checkpoints the WAL every UNDERLOG_WAL_CHECKPOINT_INTERVAL
+func runWALCheckpoints() {
+	for range time.Tick(cfg.WALCheckpointEvery) {
+		dbMutex.Lock()
+		checkpointWAL()
+		dbMutex.Unlock()
 	}
+}
 
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-	_, err = db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", req.Username, hashedPassword)
-	if err != nil {
-		// Consider checking for unique constraint violation specifically
-		log.Printf("Error inserting user %s: %v", req.Username, err)
-		http.Error(w, "Username may already be taken", http.StatusConflict) // 409 Conflict
-		return
+// closeDB flushes queued audit entries, then checkpoints and closes the database so the -wal
+// file is folded back before exit. It runs once the HTTP servers have shut down.
+func closeDB() {
+	stopAuditWriter()
+	log.Printf("Checkpointing and closing the database")
+	dbMutex.Lock() // Held until exit so nothing writes after the final checkpoint
+	checkpointWAL()
+	if err := db.Close(); err != nil {
+		logErrorf("Error closing database: %v", err)
 	}
+}
 
-	log.Printf("User registered successfully: %s", req.Username)
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
+// --- Image Storage ---
+
+// Image bytes live in an ImageStore under their content hash, so identical images share one
+// stored copy. The images table keeps the storage key, size and hash next to the image name.
+
+// ImageStore stores image bytes by key
+type ImageStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error) // Returns errImageNotStored if the key is unknown
+	Delete(key string) error        // Deleting an unknown key is not an error
 }
 
-// POST /login
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+var errImageNotStored = errors.New("image not stored")
+
+// errExternalImage is returned when reading the bytes of an image that only references a URL
+var errExternalImage = errors.New("image is hosted externally")
+
+var (
+	imageStore         ImageStore // Receives new images
+	fallbackImageStore ImageStore // The other backend, still read after switching UNDERLOG_IMAGE_STORAGE
+)
+
+// sqliteImageStore keeps image bytes in the image_blobs table
+type sqliteImageStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteImageStore) Put(key string, data []byte) error {
+	// Keys are content hashes, so an existing row already holds the same bytes
+	_, err := s.db.Exec("INSERT OR IGNORE INTO image_blobs (storage_key, blob) VALUES (?, ?)", key, data)
+	return err
+}
+
+func (s *sqliteImageStore) Get(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT blob FROM image_blobs WHERE storage_key = ?", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errImageNotStored
 	}
-	defer r.Body.Close()
+	return data, err
+}
 
-	var userID int64
-	var storedHash string
+func (s *sqliteImageStore) Delete(key string) error {
+	_, err := s.db.Exec("DELETE FROM image_blobs WHERE storage_key = ?", key)
+	return err
+}
 
-	dbMutex.Lock()
-	err := db.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", req.Username).Scan(&userID, &storedHash)
-	dbMutex.Unlock()
+// fileImageStore keeps image bytes as files under dir, sharded by the first two key characters
+type fileImageStore struct {
+	dir string
+}
+
+func (s *fileImageStore) path(key string) (string, error) {
+	if len(key) < 3 || strings.Trim(key, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid image storage key %q", key)
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
 
+func (s *fileImageStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
 	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil // Same key, same bytes
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Write to a temp file first so a crash never leaves a truncated image under the real key
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fileImageStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errImageNotStored
+	}
+	return data, err
+}
+
+func (s *fileImageStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// initImageStore selects the configured backend and moves images still stored inline in the
+// images table into it
+func initImageStore(database *sql.DB) error {
+	sqliteStore, fileStore := &sqliteImageStore{database}, &fileImageStore{cfg.ImageDir}
+	switch cfg.ImageStorage {
+	case "sqlite":
+		imageStore, fallbackImageStore = sqliteStore, fileStore
+	case "filesystem":
+		imageStore, fallbackImageStore = fileStore, sqliteStore
+	default:
+		return fmt.Errorf("unknown image storage %q, expected sqlite or filesystem", cfg.ImageStorage)
+	}
+	log.Printf("Storing images in %s", cfg.ImageStorage)
+	return moveInlineImages(database)
+}
+
+// moveInlineImages moves blobs stored in images.blob before storage keys existed into imageStore
+func moveInlineImages(database *sql.DB) error {
+	rows, err := database.Query("SELECT id FROM images WHERE storage_key IS NULL AND url IS NULL")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	if len(ids) == 0 {
+		return nil
+	}
+	log.Printf("Migrating database: moving %d images to %s storage", len(ids), cfg.ImageStorage)
+	for _, id := range ids { // One blob in memory at a time
+		var blob []byte
+		var hash string
+		if err := database.QueryRow("SELECT blob, content_hash FROM images WHERE id = ?", id).Scan(&blob, &hash); err != nil {
+			return err
+		}
+		if err := imageStore.Put(hash, blob); err != nil {
+			return err
+		}
+		if _, err := database.Exec("UPDATE images SET storage_key = ?, blob = X'' WHERE id = ?", hash, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeImage puts blob into imageStore and returns its storage key. The caller must hold dbMutex
+// and reference the key from an images row (or call releaseImageKeys) before unlocking.
+func storeImage(blob []byte) (string, error) {
+	key := contentHash(blob)
+	return key, imageStore.Put(key, blob)
+}
+
+// loadImage returns the bytes stored under key, falling back to the previously configured backend
+func loadImage(key string) ([]byte, error) {
+	data, err := imageStore.Get(key)
+	if errors.Is(err, errImageNotStored) {
+		data, err = fallbackImageStore.Get(key)
+	}
+	return data, err
+}
+
+// readProjectImage returns the bytes of a project's image, sql.ErrNoRows if it does not exist
+// or errExternalImage if it is hosted elsewhere. The caller must hold dbMutex.
+func readProjectImage(projectID int64, name string) ([]byte, error) {
+	var key sql.NullString
+	if err := db.QueryRow("SELECT storage_key FROM images WHERE project_id = ? AND name = ?", projectID, name).Scan(&key); err != nil {
+		return nil, err
+	}
+	if !key.Valid {
+		return nil, errExternalImage
+	}
+	return loadImage(key.String)
+}
+
+// storedProjectImages returns the bytes of a project's stored images by name, skipping external
+// ones, for handing the project to an external renderer. The caller must hold dbMutex.
+func storedProjectImages(projectID int64) (map[string][]byte, error) {
+	names, err := projectImageNames(projectID)
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string][]byte, len(names))
+	for _, name := range names {
+		blob, err := readProjectImage(projectID, name)
+		if err == errExternalImage {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		images[name] = blob
+	}
+	return images, nil
+}
+
+// validateImageURL checks that an external image URL is an absolute http or https URL
+func validateImageURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// projectImageKeys returns the storage keys of a project's stored images. The caller must hold dbMutex.
+func projectImageKeys(projectID int64) ([]string, error) {
+	rows, err := db.Query("SELECT storage_key FROM images WHERE project_id = ? AND storage_key IS NOT NULL", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// releaseImageKeys deletes stored bytes no longer referenced by any image. Failures only leak
+// storage, so they are logged. The caller must hold dbMutex.
+func releaseImageKeys(keys []string) {
+	for _, key := range keys {
+		var referenced bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE storage_key = ?)", key).Scan(&referenced); err != nil {
+			logErrorf("Error checking references to stored image %s: %v", key, err)
+			continue
+		}
+		if referenced {
+			continue
+		}
+		for _, store := range []ImageStore{imageStore, fallbackImageStore} {
+			if err := store.Delete(key); err != nil {
+				logErrorf("Error deleting stored image %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// --- Body Encryption ---
+
+// bodyCipher encrypts project bodies at rest when UNDERLOG_ENCRYPTION_KEY is set; nil stores plaintext
+var bodyCipher cipher.AEAD
+
+// encryptedBodyMagic starts every encrypted body, followed by the row's nonce and the AES-GCM
+// ciphertext. Encrypted bodies are stored as BLOBs and plaintext ones as TEXT, so rows written
+// before encryption was enabled still read correctly and are encrypted on their next write.
+var encryptedBodyMagic = []byte("ULE1")
+
+// plainBodyLength is an SQL expression for the plaintext byte length of a body column written by
+// sealBody, so sizes and quotas don't count the magic, the 12 byte GCM nonce and the 16 byte tag
+func plainBodyLength(column string) string {
+	overhead := len(encryptedBodyMagic) + 12 + 16
+	return fmt.Sprintf("(CASE WHEN substr(%[1]s, 1, %[2]d) = X'%[3]x' THEN length(%[1]s) - %[4]d ELSE length(CAST(%[1]s AS BLOB)) END)",
+		column, len(encryptedBodyMagic), encryptedBodyMagic, overhead)
+}
+
+// initBodyCipher sets up AES-GCM from a hex or base64 encoded 16, 24 or 32 byte key; an empty key disables encryption
+func initBodyCipher(encodedKey string) error {
+	if encodedKey == "" {
+		return nil
+	}
+	key, err := hex.DecodeString(encodedKey)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(encodedKey); err != nil {
+			return errors.New("key must be hex or base64 encoded")
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	bodyCipher, err = cipher.NewGCM(block)
+	return err
+}
+
+// sealBody returns the value to store for a project body: the body itself, or its encrypted form
+// under a fresh nonce when encryption is enabled
+func sealBody(body string) (any, error) {
+	if bodyCipher == nil {
+		return body, nil
+	}
+	sealed := make([]byte, len(encryptedBodyMagic)+bodyCipher.NonceSize(), len(encryptedBodyMagic)+bodyCipher.NonceSize()+len(body)+bodyCipher.Overhead())
+	copy(sealed, encryptedBodyMagic)
+	nonce := sealed[len(encryptedBodyMagic):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	return bodyCipher.Seal(sealed, nonce, []byte(body), nil), nil
+}
+
+// storedBody scans a body column written by sealBody, decrypting it if needed. Scan targets are
+// converted in place, e.g. (*storedBody)(&project.Body).
+type storedBody string
+
+func (b *storedBody) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*b = ""
+	case string:
+		*b = storedBody(v)
+	case []byte:
+		if !bytes.HasPrefix(v, encryptedBodyMagic) {
+			*b = storedBody(v)
+			return nil
+		}
+		if bodyCipher == nil {
+			return errors.New("body is encrypted but UNDERLOG_ENCRYPTION_KEY is not set")
+		}
+		v = v[len(encryptedBodyMagic):]
+		if len(v) < bodyCipher.NonceSize() {
+			return errors.New("encrypted body is truncated")
+		}
+		plain, err := bodyCipher.Open(nil, v[:bodyCipher.NonceSize()], v[bodyCipher.NonceSize():], nil)
+		if err != nil {
+			return fmt.Errorf("decrypting body: %w", err)
+		}
+		*b = storedBody(plain)
+	default:
+		return fmt.Errorf("unexpected body column type %T", src)
+	}
+	return nil
+}
+
+// --- Usernames ---
+
+const maxUsernameLength = 64
+
+// normalizeUsername trims surrounding whitespace and lowercases the username so that
+// registration and login agree, rejecting empty, overlong or control-character names
+func normalizeUsername(username string) (string, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return "", errors.New("username is required")
+	}
+	if utf8.RuneCountInString(username) > maxUsernameLength {
+		return "", fmt.Errorf("username must be at most %d characters", maxUsernameLength)
+	}
+	for _, r := range username {
+		if unicode.IsControl(r) {
+			return "", errors.New("username must not contain control characters")
+		}
+	}
+	return strings.ToLower(username), nil
+}
+
+// --- Database Writes ---
+
+// defaultDBBusyTimeout is the default of UNDERLOG_DB_BUSY_TIMEOUT. Writes are not retried after
+// SQLITE_BUSY: callers hold dbMutex, so the busy timeout is the longest a locked database stalls
+// other requests.
+const defaultDBBusyTimeout = 5 * time.Second
+
+// isBusyError reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// isUniqueConstraintError reports whether a write failed on a UNIQUE constraint
+func isUniqueConstraintError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// withWriteTx runs fn in a transaction and commits it, rolling back if fn or the commit fails
+func withWriteTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op after a successful commit
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbErrorStatus maps a failed database call to 503 when the database was busy or the request
+// ran out of time, and 500 otherwise
+func dbErrorStatus(err error) int {
+	if isBusyError(err) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// --- Password Hashing ---
+
+// bcrypt only reads the first 72 bytes of a password. New passwords that are longer are rejected
+// rather than truncated, so every byte the user typed counts.
+const maxPasswordBytes = 72
+
+// validatePassword checks a new password before it is hashed
+func validatePassword(password string) error {
+	if password == "" {
+		return errors.New("password is required")
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if err := validatePassword(password); err != nil {
+		return "", err
+	}
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), cfg.BcryptCost)
+	return string(bytes), err
+}
+
+// checkPasswordHash compares a password with its stored hash. Passwords over maxPasswordBytes are
+// compared truncated, as they were hashed before the limit was introduced.
+func checkPasswordHash(password, hash string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
+
+var (
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+// compareDummyPassword spends as long as checkPasswordHash does for a real user, so failed logins
+// for unknown usernames can't be told apart by response time
+func compareDummyPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		// Uses the configured cost so the comparison takes as long as one against a fresh hash
+		dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("underlog-dummy-password"), cfg.BcryptCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+}
+
+// rehashPasswordIfNeeded re-hashes a just verified password when its stored hash was made with a
+// different cost than configured. Failures are only logged; the old hash keeps working.
+func rehashPasswordIfNeeded(userID int64, password, storedHash string) {
+	cost, err := bcrypt.Cost([]byte(storedHash))
+	if err != nil || cost == cfg.BcryptCost {
+		return
+	}
+	if len(password) > maxPasswordBytes {
+		logDebugf("Not rehashing password of user %d: longer than %d bytes", userID, maxPasswordBytes)
+		return // hashPassword refuses it; the old hash keeps working until the password is changed
+	}
+	newHash, err := hashPassword(password)
+	if err != nil {
+		logErrorf("Error rehashing password for user %d: %v", userID, err)
+		return
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	// Matching the old hash avoids overwriting a password changed in the meantime
+	if _, err := db.Exec("UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?", newHash, userID, storedHash); err != nil {
+		logErrorf("Error storing rehashed password for user %d: %v", userID, err)
+		return
+	}
+	log.Printf("Rehashed password for user %d from bcrypt cost %d to %d", userID, cost, cfg.BcryptCost)
+}
+
+// --- Session Stores ---
+
+// sessionKeyPairs turns the session secrets into securecookie key pairs. Each secret is a hash
+// key without an encryption key; the first pair encodes and every pair is tried when decoding.
+func sessionKeyPairs() [][]byte {
+	var pairs [][]byte
+	for _, secret := range cfg.SessionSecrets {
+		pairs = append(pairs, []byte(secret), nil)
+	}
+	return pairs
+}
+
+// newSessionStore builds the configured session backend. The cookie store keeps all values in the
+// signed cookie; the filesystem and SQLite stores keep them server-side and the cookie only carries
+// a signed session ID, so deleting a session revokes it.
+func newSessionStore(database *sql.DB) (sessions.Store, error) {
+	switch cfg.SessionBackend {
+	case "cookie":
+		return sessions.NewCookieStore(sessionKeyPairs()...), nil
+	case "filesystem":
+		if err := os.MkdirAll(cfg.SessionDir, 0700); err != nil {
+			return nil, err
+		}
+		store := sessions.NewFilesystemStore(cfg.SessionDir, sessionKeyPairs()...)
+		store.MaxLength(0) // Values are not sent to the client, so their size is not bounded by cookie limits
+		return store, nil
+	case "sqlite":
+		go runSessionCleanup(database)
+		return newSQLiteSessionStore(database, sessionKeyPairs()...), nil
+	}
+	return nil, fmt.Errorf("unknown session backend %q, expected cookie, filesystem or sqlite", cfg.SessionBackend)
+}
+
+// sqliteSessionStore implements sessions.Store on the sessions table
+type sqliteSessionStore struct {
+	db      *sql.DB
+	codecs  []securecookie.Codec
+	options *sessions.Options // Defaults copied into every new session
+}
+
+func newSQLiteSessionStore(database *sql.DB, keyPairs ...[]byte) *sqliteSessionStore {
+	return &sqliteSessionStore{
+		db:      database,
+		codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		options: &sessions.Options{Path: "/", MaxAge: 86400 * 30},
+	}
+}
+
+// Get returns the session cached for this request, loading it on first use
+func (s *sqliteSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request cookie. Unknown or expired IDs yield a new, empty session.
+func (s *sqliteSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.codecs...); err != nil {
+		return session, err
+	}
+
+	var data string
+	dbMutex.Lock()
+	err = s.db.QueryRow("SELECT data FROM sessions WHERE id = ? AND expires_at > ?", session.ID, time.Now()).Scan(&data)
+	dbMutex.Unlock()
+	if err == sql.ErrNoRows {
+		session.ID = "" // Revoked or expired; Save issues a fresh ID
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if err := securecookie.DecodeMulti(name, data, &session.Values, s.codecs...); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session values and sets the ID cookie, or deletes the session when MaxAge <= 0
+func (s *sqliteSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if _, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = hex.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.codecs...)
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if _, err := s.db.Exec("INSERT OR REPLACE INTO sessions (id, data, expires_at) VALUES (?, ?, ?)", session.ID, data, expiresAt); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// runSessionCleanup periodically deletes expired rows from the sessions table
+func runSessionCleanup(database *sql.DB) {
+	for range time.Tick(time.Hour) {
+		dbMutex.Lock()
+		result, err := database.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now())
+		dbMutex.Unlock()
+		if err != nil {
+			logErrorf("Error deleting expired sessions: %v", err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("Deleted %d expired sessions", n)
+		}
+	}
+}
+
+// setSessionCookieOptions applies the session cookie attributes. Stores start every request from
+// their default options, so each save of the session sets them again.
+func setSessionCookieOptions(opts *sessions.Options) {
+	opts.HttpOnly = true       // Prevent client-side script access
+	opts.Secure = tlsEnabled() // Only send the cookie over HTTPS when serving TLS
+	opts.SameSite = cfg.SessionSameSite
+	opts.Path = cfg.BasePath + "/" // Scope the cookie to the app when it shares a host with others
+	if opts.SameSite == http.SameSiteNoneMode && !opts.Secure {
+		opts.SameSite = http.SameSiteLaxMode // Browsers reject SameSite=None cookies without Secure
+	}
+}
+
+// --- Rate Limiting ---
+
+// rateLimiter is a token bucket per key (e.g. a client IP): each key may burst up to limit
+// requests, and regains tokens continuously at limit per window
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	buckets   map[string]*rateBucket
+	nextSweep time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, buckets: make(map[string]*rateBucket)}
+}
+
+// refill adds the tokens regained since the bucket was last updated, up to the limit
+func (l *rateLimiter) refill(b *rateBucket, now time.Time) {
+	perToken := l.window / time.Duration(l.limit)
+	b.tokens = min(float64(l.limit), b.tokens+float64(now.Sub(b.updated))/float64(perToken))
+	b.updated = now
+}
+
+// allow takes a token for key, returning false and the time until the next token once the
+// bucket is empty
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.After(l.nextSweep) {
+		// Forget keys whose bucket has refilled so the map doesn't grow without bound
+		for k, b := range l.buckets {
+			if l.refill(b, now); b.tokens >= float64(l.limit) {
+				delete(l.buckets, k)
+			}
+		}
+		l.nextSweep = now.Add(l.window)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: float64(l.limit), updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		perToken := l.window / time.Duration(l.limit)
+		return false, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rejectRateLimited takes a token for key and answers 429 with Retry-After if there is none,
+// returning true when the request was rejected
+func rejectRateLimited(l *rateLimiter, w http.ResponseWriter, r *http.Request, key, client string) bool {
+	ok, retryAfter := l.allow(key)
+	if ok {
+		return false
+	}
+	logWarnf("Rate limit exceeded for %s on %s", client, r.URL.Path)
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	http.Error(w, "Too many requests, please slow down", http.StatusTooManyRequests)
+	return true
+}
+
+// rateLimitByIP answers 429 with Retry-After once a client IP exceeds the limiter's rate.
+// A nil limiter disables the check.
+func rateLimitByIP(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !rejectRateLimited(l, w, r, clientIP(r), clientIP(r)) {
+			next(w, r)
+		}
+	}
+}
+
+// rateLimitByUser answers 429 with Retry-After once the authenticated user exceeds the limiter's
+// rate, so one account can't monopolize the server from many IPs. A nil limiter disables the check.
+func rateLimitByUser(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(userIDContextKey).(int64)
+		if !rejectRateLimited(l, w, r, strconv.FormatInt(userID, 10), fmt.Sprintf("user %d", userID)) {
+			next(w, r)
+		}
+	}
+}
+
+// rateLimitBySession is rateLimitByUser for public routes: requests carrying a valid session
+// count against that user, anonymous ones pass through to the IP limit alone
+func rateLimitBySession(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := sessionUserID(r)
+		if userID == 0 || !rejectRateLimited(l, w, r, strconv.FormatInt(userID, 10), fmt.Sprintf("user %d", userID)) {
+			next(w, r)
+		}
+	}
+}
+
+// limitRequestBody caps the request body at limit bytes; reads past it fail with *http.MaxBytesError
+func limitRequestBody(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	if limit <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r)
+	}
+}
+
+// --- Middleware ---
+
+const (
+	sessionLoginAtKey         = "loginAt"      // Session value: unix time of login
+	sessionLastActivityKey    = "lastActivity" // Session value: unix time of the last authenticated request
+	sessionActivityResolution = time.Minute    // Don't re-issue the session cookie more often than this
+)
+
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionKeyName)
+		if err != nil {
+			// Stores hand back a fresh session alongside the error, which then fails the check below
+			logErrorf("Auth middleware: Error getting session: %v", err)
+		}
+		if session == nil {
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+
+		userID, ok := session.Values[userIDContextKey].(int64)
+		if !ok || userID == 0 {
+			logDebugf("Auth middleware: Unauthorized access attempt to %s", r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Enforce the absolute and idle lifetimes, then slide the idle window forward
+		now := time.Now()
+		loginAt, _ := session.Values[sessionLoginAtKey].(int64)
+		lastActivity, _ := session.Values[sessionLastActivityKey].(int64)
+		if loginAt == 0 || lastActivity == 0 {
+			// Session predates activity tracking; start tracking from now
+			loginAt, lastActivity = now.Unix(), 0
+		}
+		if now.Sub(time.Unix(loginAt, 0)) > cfg.SessionMaxAge ||
+			(lastActivity != 0 && cfg.SessionIdleTimeout > 0 && now.Sub(time.Unix(lastActivity, 0)) > cfg.SessionIdleTimeout) {
+			logDebugf("Auth middleware: Session of user %d expired", userID)
+			delete(session.Values, userIDContextKey)
+			setSessionCookieOptions(session.Options)
+			session.Options.MaxAge = -1
+			if err := session.Save(r, w); err != nil {
+				logErrorf("Auth middleware: Error clearing expired session: %v", err)
+			}
+			http.Error(w, "Session expired", http.StatusUnauthorized)
+			return
+		}
+		refreshAfter := sessionActivityResolution
+		if cfg.SessionIdleTimeout > 0 && cfg.SessionIdleTimeout/2 < refreshAfter {
+			refreshAfter = cfg.SessionIdleTimeout / 2
+		}
+		if now.Sub(time.Unix(lastActivity, 0)) > refreshAfter {
+			session.Values[sessionLoginAtKey] = loginAt
+			session.Values[sessionLastActivityKey] = now.Unix()
+			setSessionCookieOptions(session.Options)
+			session.Options.MaxAge = int(time.Until(time.Unix(loginAt, 0).Add(cfg.SessionMaxAge)).Seconds())
+			if err := session.Save(r, w); err != nil {
+				logErrorf("Auth middleware: Error refreshing session of user %d: %v", userID, err)
+			}
+		}
+
+		// Add user ID to context for handlers to use
+		ctx := context.WithValue(r.Context(), userIDContextKey, userID)
+		logDebugf("Auth middleware: User %d authorized for %s", userID, r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare IPs
+func parseTrustedProxies(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			logWarnf("Ignoring invalid trusted proxy %q: %v", entry, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range cfg.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP returns the address of the connecting peer, or, when that peer is a trusted
+// proxy, the right-most untrusted address from X-Forwarded-For (falling back to X-Real-IP)
+func resolveClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !isTrustedProxy(peer) {
+		return host
+	}
+
+	// Walk the chain from the nearest hop outwards; everything left of an untrusted hop is client-controlled
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// corsAllowedMethods are announced to preflight requests
+const corsAllowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE"
+
+// corsExposedHeaders are response headers cross-origin scripts may read
+const corsExposedHeaders = "ETag, Content-Location, Retry-After, X-Total-Count, X-PDF-Page-Count"
+
+// parseCORSOrigins normalizes the configured CORS origins, dropping invalid entries. "*" is kept as is.
+func parseCORSOrigins(values []string) []string {
+	var origins []string
+	for _, value := range values {
+		if value == "*" {
+			origins = append(origins, value)
+			continue
+		}
+		origin, err := normalizeOrigin(value)
+		if err != nil {
+			logWarnf("Ignoring invalid CORS origin %q: %v", value, err)
+			continue
+		}
+		origins = append(origins, origin)
+	}
+	return origins
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin value for a request origin, or "" when
+// the origin is not allowed. Credentials are only allowed for an explicitly listed origin, which is
+// echoed back; the "*" wildcard never carries them, as browsers reject that combination.
+func corsAllowOrigin(origin string) (allow string, credentials bool) {
+	if origin == "" {
+		return "", false
+	}
+	wildcard := false
+	normalized, err := normalizeOrigin(origin)
+	for _, allowed := range cfg.CORSOrigins {
+		if allowed == "*" {
+			wildcard = true
+		} else if err == nil && allowed == normalized {
+			return origin, true
+		}
+	}
+	if wildcard {
+		return "*", false
+	}
+	return "", false
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers their preflight requests
+// directly, so every route (including ones behind authMiddleware) can be preflighted.
+// Requests from other origins pass through without CORS headers and are blocked by the browser.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.CORSOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allow, credentials := corsAllowOrigin(r.Header.Get("Origin"))
+		if allow == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", allow)
+		if credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+			if cfg.CORSMaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.CORSMaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// optionsHandler answers OPTIONS requests corsMiddleware did not handle (CORS disabled, origin
+// not allowed, or no preflight headers) so mux does not reply 405 for routes without an OPTIONS method
+func optionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", corsAllowedMethods+", OPTIONS")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clientIPMiddleware stores the resolved client IP in the request context
+func clientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey, resolveClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the client IP resolved by clientIPMiddleware
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	return resolveClientIP(r)
+}
+
+// statusRecorder captures the status code and byte count written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. for Flush)
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requestLogMiddleware logs one JSON line per request with its status, size and latency.
+// It wraps the whole router so static files and unmatched routes are covered too.
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK // Handler wrote nothing
+		}
+
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", clientIP(r)),
+		)
+	})
+}
+
+// timeoutWriter passes writes straight through until the request deadline passes. If the handler
+// has not started its response by then, a 503 is sent in its place and later writes are dropped.
+// The handler gets its own header map, copied to the real one when it starts its response, so the
+// timeout can write headers without racing a handler that is still setting them.
+type timeoutWriter struct {
+	http.ResponseWriter
+	h           http.Header
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	finished    bool // The handler has returned
+}
+
+func newTimeoutWriter(w http.ResponseWriter) *timeoutWriter {
+	return &timeoutWriter{ResponseWriter: w, h: w.Header().Clone()} // Keep headers set by outer middleware
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+// startResponse copies the handler's headers to the real writer; the caller holds tw.mu
+func (tw *timeoutWriter) startResponse() {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.ResponseWriter.Header()
+	clear(dst)
+	maps.Copy(dst, tw.h)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.startResponse()
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.startResponse()
+	return tw.ResponseWriter.Write(b)
+}
+
+// Flush sends the handler's headers along before flushing, like Write does
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.startResponse()
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. for deadlines)
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// timeout answers 503 unless the handler has already begun writing or has finished
+func (tw *timeoutWriter) timeout() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.finished || tw.wroteHeader {
+		return
+	}
+	tw.timedOut = true
+	http.Error(tw.ResponseWriter, "Request timed out, please try again", http.StatusServiceUnavailable)
+	http.NewResponseController(tw.ResponseWriter).Flush() // Don't wait for the handler to give up
+}
+
+// isLongRunningRequest reports whether a request goes to a route that legitimately takes longer
+// than everything else: PDF generation, bulk imports and exports, zip downloads, chunked uploads
+// and VACUUM
+func isLongRunningRequest(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/account/import", "/api/account/export", "/api/admin/vacuum":
+		return true
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/projects/") {
+		for _, suffix := range []string{"/pdf", "/images.zip", "/images/download", "/upload"} {
+			if strings.HasSuffix(r.URL.Path, suffix) {
+				return true
+			}
+		}
+	}
+	return r.URL.Path == "/pdf" || strings.HasPrefix(r.URL.Path, "/pdf/")
+}
+
+// requestTimeout picks the time limit for a request
+func requestTimeout(r *http.Request) time.Duration {
+	if isLongRunningRequest(r) {
+		return cfg.PDFRequestTimeout
+	}
+	return cfg.RequestTimeout
+}
+
+// extendConnDeadlines pushes the server's read and write deadlines out for long-running routes, so
+// an upload or a PDF response is not cut off by the timeouts meant for ordinary requests
+func extendConnDeadlines(w http.ResponseWriter) {
+	var deadline time.Time // Zero clears the deadline when the long request timeout is disabled
+	if cfg.PDFRequestTimeout > 0 {
+		deadline = time.Now().Add(cfg.PDFRequestTimeout + cfg.WriteTimeout) // WriteTimeout is the margin for sending the result
+	}
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		logErrorf("Error extending read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		logErrorf("Error extending write deadline: %v", err)
+	}
+}
+
+// timeoutMiddleware bounds how long a handler may work on a request. The deadline travels in the
+// request context, so database calls and PDF tools started with it are cancelled when it passes.
+// Unlike http.TimeoutHandler it does not buffer responses, so downloads are still streamed.
+func timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isEventStreamRequest(r) {
+			next.ServeHTTP(w, r) // Streams manage their own deadlines
+			return
+		}
+		if isLongRunningRequest(r) {
+			extendConnDeadlines(w)
+		}
+
+		timeout := requestTimeout(r)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := newTimeoutWriter(w)
+		stop := context.AfterFunc(ctx, func() {
+			if ctx.Err() == context.DeadlineExceeded {
+				tw.timeout()
+			}
+		})
+		defer stop()
+
+		next.ServeHTTP(tw, r.WithContext(ctx))
+
+		tw.mu.Lock()
+		tw.finished = true // A timeout firing after this point must not write
+		tw.mu.Unlock()
+	})
+}
+
+// --- Handler Helpers ---
+
+// projectIDFromRequest parses the {id} route variable, responding with 400 if it is invalid
+func projectIDFromRequest(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	projectID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return projectID, true
+}
+
+// requireProjectOwner verifies the project exists and belongs to userID, responding with
+// 404/403 otherwise. The caller must hold dbMutex.
+func requireProjectOwner(w http.ResponseWriter, projectID, userID int64) bool {
+	var ownerUserID int64
+	err := db.QueryRow("SELECT user_id FROM projects WHERE id = ?", projectID).Scan(&ownerUserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error checking owner of project %d for user %d: %v", projectID, userID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return false
+	}
+	if ownerUserID != userID {
+		logWarnf("User %d attempted to access project %d owned by user %d", userID, projectID, ownerUserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// projectContentTypes are the body formats a project can declare
+var projectContentTypes = []string{svgContentType, markdownContentType}
+
+// validateProjectContentType accepts the known body formats, and empty for the caller's default
+func validateProjectContentType(contentType string) error {
+	if contentType != "" && !slices.Contains(projectContentTypes, contentType) {
+		return fmt.Errorf("unsupported content type %q, expected one of %s", contentType, strings.Join(projectContentTypes, ", "))
+	}
+	return nil
+}
+
+// validateProjectName trims surrounding whitespace, collapses inner runs of whitespace to one
+// space and enforces the configured length limit, rejecting control characters other than
+// whitespace. An empty result is allowed unless UNDERLOG_REQUIRE_PROJECT_NAME is set; callers
+// fall back to defaultProjectName.
+func validateProjectName(name string) (string, error) {
+	// Collapsed first so tabs and newlines become spaces; "Title\n" and "My\tProject" are fine
+	name = strings.Join(strings.Fields(name), " ") // " My  Project " and "My Project" are the same name
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", errors.New("must not contain control characters")
+		}
+	}
+	if name == "" && cfg.RequireProjectName {
+		return "", errors.New("must not be empty")
+	}
+	if cfg.MaxProjectNameLength > 0 && utf8.RuneCountInString(name) > cfg.MaxProjectNameLength {
+		return "", fmt.Errorf("must be at most %d characters", cfg.MaxProjectNameLength)
+	}
+	return name, nil
+}
+
+// paginationParams parses ?limit= and ?offset=, responding with 400 if they are invalid
+func paginationParams(w http.ResponseWriter, r *http.Request, defaultLimit, maxLimit int) (int, int, bool) {
+	limit, offset := defaultLimit, 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit, expected 1-%d", maxLimit), http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if value := r.URL.Query().Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+// rowsQuerier is satisfied by *sql.DB and *sql.Tx
+type rowsQuerier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// findCaseCollision returns the first name selected by query that differs from name only in case,
+// or "" when there is none or UNDERLOG_CASE_INSENSITIVE_NAMES is off. The caller must hold dbMutex.
+func findCaseCollision(q rowsQuerier, name, query string, args ...any) (string, error) {
+	if !cfg.CaseInsensitiveNames {
+		return "", nil
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var existing string
+		if err := rows.Scan(&existing); err != nil {
+			return "", err
+		}
+		if existing != name && strings.EqualFold(existing, name) {
+			return existing, nil
+		}
+	}
+	return "", rows.Err()
+}
+
+// findFoldedDuplicate returns two names of the list that differ only in case, when
+// UNDERLOG_CASE_INSENSITIVE_NAMES is on
+func findFoldedDuplicate(names []string) (string, string, bool) {
+	if !cfg.CaseInsensitiveNames {
+		return "", "", false
+	}
+	seen := make(map[string]string)
+	for _, name := range names {
+		folded := strings.ToLower(name)
+		if other, ok := seen[folded]; ok && other != name {
+			return other, name, true
+		}
+		seen[folded] = name
+	}
+	return "", "", false
+}
+
+// validateImageName rejects image names that could be misread as paths or break headers:
+// slashes, backslashes, control characters, "." and "..", overlong names, and (when
+// UNDERLOG_IMAGE_NAME_PATTERN is set) names not matching the configured pattern
+func validateImageName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return errors.New("name is empty or a path component")
+	}
+	if cfg.MaxImageNameLength > 0 && utf8.RuneCountInString(name) > cfg.MaxImageNameLength {
+		return fmt.Errorf("must be at most %d characters", cfg.MaxImageNameLength)
+	}
+	if strings.ContainsAny(name, "/\\") {
+		return errors.New("must not contain slashes")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return errors.New("must not contain control characters")
+		}
+	}
+	if cfg.ImageNamePattern != nil && !cfg.ImageNamePattern.MatchString(name) {
+		return fmt.Errorf("must match %s", cfg.ImageNamePattern)
+	}
+	return nil
+}
+
+// keyedMutex hands out one mutex per key. Entries are reference counted and dropped once nobody
+// holds or waits for them, so the map only grows with the keys in use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[any]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	sync.Mutex
+	refs int
+}
+
+// lock acquires the mutex for key and returns the unlock function
+func (m *keyedMutex) lock(key any) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[any]*keyedMutexEntry)
+	}
+	entry := m.locks[key]
+	if entry == nil {
+		entry = &keyedMutexEntry{}
+		m.locks[key] = entry
+	}
+	entry.refs++
+	m.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		m.mu.Lock()
+		if entry.refs--; entry.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// projectLocks holds one mutex per project ID being modified
+var projectLocks keyedMutex
+
+// lockProject acquires the advisory lock for a project so that modifications of the same
+// project are fully serialized while different projects proceed independently. Always
+// acquire it before dbMutex. It returns the unlock function.
+func lockProject(projectID int64) func() {
+	return projectLocks.lock(projectID)
+}
+
+// bodyTemplate is the body new projects start with, loaded at startup by loadBodyTemplate
+var bodyTemplate = builtinBodyTemplate
+
+// loadBodyTemplate reads the UNDERLOG_DEFAULT_TEMPLATE file, if configured
+func loadBodyTemplate() error {
+	if cfg.DefaultTemplate == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.DefaultTemplate)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxBodyBytes > 0 && len(data) > cfg.MaxBodyBytes {
+		return fmt.Errorf("template is %d bytes, exceeding the body limit of %d bytes", len(data), cfg.MaxBodyBytes)
+	}
+	bodyTemplate = string(data)
+	log.Printf("Loaded default project body template from %s", cfg.DefaultTemplate)
+	return nil
+}
+
+// projectBodyTemplate returns the starting body for a new project of userID. The template is
+// per instance for now; userID is where per-user templates would be looked up. It is written
+// for the SVG renderer, so projects of other content types start empty.
+func projectBodyTemplate(userID int64, contentType string) string {
+	if contentType != svgContentType {
+		return ""
+	}
+	return bodyTemplate
+}
+
+// checkBodySize responds with 413 if a project body exceeds the configured limit
+func checkBodySize(w http.ResponseWriter, body string) bool {
+	if cfg.MaxBodyBytes > 0 && len(body) > cfg.MaxBodyBytes {
+		http.Error(w, fmt.Sprintf("Project body is %d bytes, exceeding the limit of %d bytes", len(body), cfg.MaxBodyBytes), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// checkImageCount responds with 400 if a project would hold more images than the configured limit
+func checkImageCount(w http.ResponseWriter, count int) bool {
+	if cfg.MaxImages > 0 && count > cfg.MaxImages {
+		http.Error(w, fmt.Sprintf("Project has %d images, exceeding the limit of %d images", count, cfg.MaxImages), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// imageCountError reports a project image count above the configured limit
+func imageCountError(count int) error {
+	if cfg.MaxImages > 0 && count > cfg.MaxImages {
+		return fmt.Errorf("project has %d images, exceeding the limit of %d images", count, cfg.MaxImages)
+	}
+	return nil
+}
+
+// --- Validation ---
+
+// FieldError describes one invalid request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every problem with a request so clients can show them all at once
+type ValidationErrors struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (v *ValidationErrors) add(field, message string) {
+	v.Errors = append(v.Errors, FieldError{Field: field, Message: message})
+}
+
+// check records err against field if it is not nil
+func (v *ValidationErrors) check(field string, err error) {
+	if err != nil {
+		v.add(field, err.Error())
+	}
+}
+
+// respond writes the collected errors as 422 Unprocessable Entity, reporting whether there were any
+func (v *ValidationErrors) respond(w http.ResponseWriter) bool {
+	if len(v.Errors) == 0 {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(v)
+	return true
+}
+
+// --- Handlers ---
+
+// POST /register
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var validation ValidationErrors
+	username, err := normalizeUsername(req.Username)
+	validation.check("username", err)
+	validation.check("password", validatePassword(req.Password))
+	if validation.respond(w) {
+		return
+	}
+	req.Username = username
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		logErrorf("Error hashing password for %s: %v", req.Username, err)
+		http.Error(w, "Failed to process registration", http.StatusInternalServerError)
+		return
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	_, err = db.ExecContext(r.Context(), "INSERT INTO users (username, password_hash) VALUES (?, ?)", req.Username, hashedPassword)
+	if err != nil {
+		// Consider checking for unique constraint violation specifically
+		logErrorf("Error inserting user %s: %v", req.Username, err)
+		http.Error(w, "Username may already be taken", http.StatusConflict) // 409 Conflict
+		return
+	}
+
+	log.Printf("User registered successfully: %s", req.Username)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
+}
+
+// POST /login
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	username, err := normalizeUsername(req.Username)
+	if err != nil {
+		compareDummyPassword(req.Password)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	req.Username = username
+
+	var userID int64
+	var storedHash string
+
+	dbMutex.Lock()
+	err = db.QueryRow("SELECT id, password_hash FROM users WHERE username = ? COLLATE NOCASE", req.Username).Scan(&userID, &storedHash)
+	dbMutex.Unlock()
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("Login attempt failed for %s: user not found", req.Username)
+			compareDummyPassword(req.Password)
+			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		} else {
+			logErrorf("Error querying user %s: %v", req.Username, err)
+			http.Error(w, "Login failed", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !checkPasswordHash(req.Password, storedHash) {
+		log.Printf("Login attempt failed for %s: incorrect password", req.Username)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	rehashPasswordIfNeeded(userID, req.Password, storedHash)
+
+	// Start from a fresh session with a new ID. The server-side stores would otherwise authenticate
+	// whatever session ID the request carried, including one planted by an attacker.
+	session, _ := sessionStore.Get(r, sessionKeyName)
+	if session.ID != "" { // Cookie sessions have no ID; their values are replaced below
+		session.Options.MaxAge = -1
+		if err := session.Save(r, w); err != nil {
+			logWarnf("Error discarding pre-login session: %v", err)
+		}
+	}
+	session.ID = ""
+	session.IsNew = true
+	session.Values = make(map[interface{}]interface{})
+	session.Values[userIDContextKey] = userID
+	session.Values[sessionLoginAtKey] = time.Now().Unix()
+	session.Values[sessionLastActivityKey] = time.Now().Unix()
+	setSessionCookieOptions(session.Options)
+	session.Options.MaxAge = int(cfg.SessionMaxAge.Seconds()) // Absolute expiry
+	err = session.Save(r, w)
+	if err != nil {
+		logErrorf("Error saving session for user %d: %v", userID, err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User logged in successfully: %s (ID: %d)", req.Username, userID)
+	recordAudit(r, userID, auditActionLogin, userID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
+}
+
+// POST /logout
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, sessionKeyName)
+	// Clear session data
+	session.Values[userIDContextKey] = nil
+	setSessionCookieOptions(session.Options)
+	session.Options.MaxAge = -1 // Expire cookie immediately
+	err := session.Save(r, w)
+	if err != nil {
+		logErrorf("Error saving session during logout: %v", err)
+		http.Error(w, "Logout failed", http.StatusInternalServerError)
+		return
+	}
+	log.Println("User logged out")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logout successful"})
+}
+
+// validateSVGInput checks that the input is well-formed XML made of one or more <svg> documents
+// (one per page, at most UNDERLOG_MAX_PDF_PAGES), so the PDF tools never see arbitrary text.
+// Entity declarations, which the tools might expand or resolve, <script> elements, on* event
+// handler attributes and javascript: URLs are rejected. Returns the page count.
+func validateSVGInput(input string) (int, error) {
+	pages, err := walkSVGPages(input, func(token xml.Token) error {
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "script" {
+				return errors.New("<script> elements are not allowed")
+			}
+			for _, attr := range t.Attr {
+				if strings.HasPrefix(strings.ToLower(attr.Name.Local), "on") {
+					return fmt.Errorf("event handler attribute %s on <%s> is not allowed", attr.Name.Local, t.Name.Local)
+				}
+				if isJavaScriptURL(attr.Value) {
+					return fmt.Errorf("javascript: URL in %s on <%s> is not allowed", attr.Name.Local, t.Name.Local)
+				}
+			}
+		case xml.Directive:
+			if bytes.Contains(t, []byte("ENTITY")) {
+				return errors.New("entity declarations are not allowed")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return pages, err
+	}
+	if cfg.MaxPDFPages > 0 && pages > cfg.MaxPDFPages {
+		return pages, fmt.Errorf("more than %d pages", cfg.MaxPDFPages)
+	}
+	return pages, nil
+}
+
+// isJavaScriptURL reports whether value is a javascript: URL. Browsers ignore whitespace and
+// control characters inside the scheme, so "java\tscript:" counts too.
+func isJavaScriptURL(value string) bool {
+	scheme := strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, value)
+	return strings.HasPrefix(scheme, "javascript:")
+}
+
+// pdfError is returned by the PDF pipeline; Message is safe to show to the client
+type pdfError struct {
+	Message string
+	Err     error
+}
+
+func (e *pdfError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *pdfError) Unwrap() error {
+	return e.Err
+}
+
+// errPageNotFound is wrapped in a pdfError when a requested page does not exist
+var errPageNotFound = errors.New("page not found")
+
+// generatePDF runs the split/convert/combine pipeline over the SVG input and writes the PDF to destPath.
+// A page greater than zero converts only that (1-based) page and skips the combine step.
+// The external tools are killed if ctx is cancelled.
+func generatePDF(ctx context.Context, svg string, page int, destPath string) error {
+	logDebugf("Received PDF generation request, creating temp directory...")
+
+	// 1. Create a temporary directory
+	tempDir, err := os.MkdirTemp("", pdfTempDirPrefix)
+	if err != nil {
+		logErrorf("Failed to create temporary directory: %v", err)
+		return &pdfError{"Failed to process request (temp dir)", err}
+	}
+	logDebugf("Temporary directory created: %s", tempDir)
+	defer func() {
+		logDebugf("Cleaning up temporary directory: %s", tempDir)
+		if err := os.RemoveAll(tempDir); err != nil {
+			logErrorf("Error cleaning up temporary directory %s: %v", tempDir, err)
+		}
+	}()
+
+	// 2. Write the SVG input to a file in the temp directory
+	svgFilePath := filepath.Join(tempDir, "underlog.svg")
+	if err := os.WriteFile(svgFilePath, []byte(svg), 0644); err != nil {
+		logErrorf("Failed to write SVG to temporary file %s: %v", svgFilePath, err)
+		return &pdfError{"Failed to process request (write SVG)", err}
+	}
+	logDebugf("SVG content written to %s", svgFilePath)
+
+	// 3. Execute the bash scripts sequentially
+
+	// Script 1: awk to split SVG
+	awkCmd := `awk '/<svg/{n++} n{print > "input_" n ".svg"}' underlog.svg`
+	logDebugf("Executing awk command in %s: %s", tempDir, awkCmd)
+	cmd1 := pdfToolCommand(ctx, tempDir, "bash", "-c", awkCmd)
+	output1, err := cmd1.CombinedOutput()
+	if err != nil {
+		logErrorf("Error executing awk command: %v\nOutput: %s", err, string(output1))
+		return &pdfError{"Failed to process SVG (split step)", err}
+	}
+	logDebugf("awk command successful.")
+
+	if page > 0 {
+		return convertSinglePage(ctx, tempDir, page, destPath)
+	}
+
+	// Script 2: svg2pdf loop
+	svg2pdfCmd := `for file in input_*.svg; do svg2pdf "$file" "${file%.svg}.pdf"; done`
+	logDebugf("Executing svg2pdf loop in %s: %s", tempDir, svg2pdfCmd)
+	cmd2 := pdfToolCommand(ctx, tempDir, "bash", "-c", svg2pdfCmd)
+	output2, err := cmd2.CombinedOutput()
+	if err != nil {
+		logErrorf("Error executing svg2pdf loop: %v\nOutput: %s", err, string(output2))
+		return &pdfError{"Failed to process SVG (conversion step)", err}
+	}
+	logDebugf("svg2pdf loop successful.")
+
+	// Script 3: gs to combine PDFs
+	gsCmd := `gs -sDEVICE=pdfwrite -dCompatibilityLevel=1.5 -dPDFSETTINGS=/default -dNOPAUSE -dQUIET -dBATCH -dDetectDuplicateImages -dCompressFonts=true -r150 -sOutputFile=underlog.pdf $(printf '%s\n' input_*.pdf | sort -V | tr '\n' ' ')`
+	logDebugf("Executing gs command in %s: %s", tempDir, gsCmd)
+	cmd3 := pdfToolCommand(ctx, tempDir, "bash", "-c", gsCmd)
+	output3, err := cmd3.CombinedOutput()
+	if err != nil {
+		logErrorf("Error executing gs command: %v\nOutput: %s", err, string(output3))
+		return &pdfError{"Failed to process SVG (combine step)", err}
+	}
+	logDebugf("gs command successful.")
+
+	// 4. Move the resulting underlog.pdf out before the temp dir is removed, without loading it into memory
+	pdfFilePath := filepath.Join(tempDir, "underlog.pdf")
+	if err := moveFile(pdfFilePath, destPath); err != nil {
+		logErrorf("Failed to move generated PDF file %s to %s: %v", pdfFilePath, destPath, err)
+		return &pdfError{"Failed to retrieve generated PDF", err}
+	}
+	log.Printf("Successfully generated %s", destPath)
+	return nil
+}
+
+// convertSinglePage converts input_<page>.svg from an already split document straight to destPath
+func convertSinglePage(ctx context.Context, tempDir string, page int, destPath string) error {
+	pages, err := filepath.Glob(filepath.Join(tempDir, "input_*.svg"))
+	if err != nil {
+		return &pdfError{"Failed to process SVG (split step)", err}
+	}
+	if page > len(pages) {
+		return &pdfError{fmt.Sprintf("Page %d not found, the document has %d pages", page, len(pages)), errPageNotFound}
+	}
+
+	svgName := fmt.Sprintf("input_%d.svg", page)
+	pdfName := fmt.Sprintf("input_%d.pdf", page)
+	logDebugf("Executing svg2pdf for page %d in %s", page, tempDir)
+	cmd := pdfToolCommand(ctx, tempDir, "svg2pdf", svgName, pdfName)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		logErrorf("Error executing svg2pdf for page %d: %v\nOutput: %s", page, err, string(output))
+		return &pdfError{"Failed to process SVG (conversion step)", err}
+	}
+
+	if err := moveFile(filepath.Join(tempDir, pdfName), destPath); err != nil {
+		logErrorf("Failed to move generated page PDF to %s: %v", destPath, err)
+		return &pdfError{"Failed to retrieve generated PDF", err}
+	}
+	log.Printf("Successfully generated page %d as %s", page, destPath)
+	return nil
+}
+
+// pdfToolCommand prepares an external tool run in dir that is killed when ctx is done. The tool
+// gets its own process group so the loops run by "bash -c" are killed along with their children.
+func pdfToolCommand(ctx context.Context, dir, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second // Backstop if something still holds the output pipe
+	return cmd
+}
+
+// pdfTools are the executables the PDF pipeline runs
+var pdfTools = []string{"bash", "awk", "svg2pdf", "gs"}
+
+// missingPDFTools returns the PDF pipeline executables that cannot be found in PATH
+func missingPDFTools() []string {
+	missing := []string{}
+	for _, tool := range pdfTools {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	return missing
+}
+
+// PDFHealthResponse is returned by /healthz/pdf
+type PDFHealthResponse struct {
+	OK      bool     `json:"ok"`
+	Missing []string `json:"missing"`
+}
+
+// GET /healthz/pdf (Public)
+// Reports whether every PDF tool is installed; 503 when /pdf cannot work
+func pdfHealthHandler(w http.ResponseWriter, r *http.Request) {
+	missing := missingPDFTools()
+	w.Header().Set("Content-Type", "application/json")
+	if len(missing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(PDFHealthResponse{OK: len(missing) == 0, Missing: missing})
+}
+
+// removeStalePDFTempDirs deletes PDF work directories that generatePDF never cleaned up because
+// the process died mid-request. Directories younger than the PDF request timeout may still be in use.
+func removeStalePDFTempDirs() {
+	entries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		logErrorf("Error reading temp directory: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-max(cfg.PDFTempMaxAge, cfg.PDFRequestTimeout))
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), pdfTempDirPrefix) || entry.Name() == pdfCacheDirName {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(os.TempDir(), entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			logErrorf("Failed to remove stale PDF temp directory %s: %v", path, err)
+			continue
+		}
+		log.Printf("Removed stale PDF temp directory %s", path)
+	}
+}
+
+// runPDFTempCleanup sweeps leftover PDF work directories and expired chunked uploads at startup
+// and then hourly
+func runPDFTempCleanup() {
+	removeStalePDFTempDirs()
+	removeStaleUploads()
+	for range time.Tick(time.Hour) {
+		removeStalePDFTempDirs()
+		removeStaleUploads()
+	}
+}
+
+// moveFile renames src to dst, falling back to a streamed copy across filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// --- PDF Cache ---
+
+// Generated PDFs are cached on disk keyed by the SHA-256 of their SVG input, so an identical
+// request reuses the same bytes and interrupted downloads can resume with a Range request.
+
+// pdfCacheLocks serializes work on one cache entry, so an identical request waits for the PDF
+// being generated instead of generating it again, while different PDFs are generated in parallel
+var pdfCacheLocks keyedMutex
+
+// pdfPageCounts remembers the page count of each cached PDF by hash, so Ghostscript runs once per PDF
+var pdfPageCounts sync.Map
+
+// cachedPDFPageCount returns the number of pages in the cached PDF, 0 if it can't be counted
+func cachedPDFPageCount(ctx context.Context, path, hash string) int {
+	if pages, ok := pdfPageCounts.Load(hash); ok {
+		return pages.(int)
+	}
+	pages := pdfFilePageCount(ctx, path)
+	if pages > 0 {
+		pdfPageCounts.Store(hash, pages)
+	}
+	return pages
+}
+
+func pdfCacheDir() string {
+	return filepath.Join(os.TempDir(), pdfCacheDirName)
+}
+
+func pdfCachePath(hash string) string {
+	return filepath.Join(pdfCacheDir(), hash+".pdf")
+}
+
+// cachedPDF returns the path of the cached PDF for the SVG input, generating it if needed
+func cachedPDF(ctx context.Context, svg string, page int) (string, string, error) {
+	key := svg
+	if page > 0 {
+		key += fmt.Sprintf("\x00page=%d", page)
+	}
+	return cachedPDFFile(key, func(destPath string) error {
+		return generatePDF(ctx, svg, page, destPath)
+	})
+}
+
+// cachedPDFFile returns the path and hash of the cached PDF for key, calling generate to write it
+// if it is not cached yet
+func cachedPDFFile(key string, generate func(destPath string) error) (string, string, error) {
+	hash := contentHash([]byte(key))
+	path := pdfCachePath(hash)
+
+	unlock := pdfCacheLocks.lock(path)
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		logDebugf("Serving cached PDF %s", hash)
+		os.Chtimes(path, time.Now(), time.Now()) // Keep recently used entries alive
+		return path, hash, nil
+	}
+
+	if err := os.MkdirAll(pdfCacheDir(), 0700); err != nil {
+		logErrorf("Failed to create PDF cache directory: %v", err)
+		return "", "", &pdfError{"Failed to store generated PDF", err}
+	}
+	tmpPath := path + ".tmp"
+	if err := generate(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", "", err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		logErrorf("Failed to finalize PDF cache entry %s: %v", path, err)
+		return "", "", &pdfError{"Failed to store generated PDF", err}
+	}
+
+	prunePDFCache()
+	return path, hash, nil
+}
+
+// prunePDFCache removes cache entries unused for longer than the configured TTL. Entries being
+// generated are written to fresh .tmp files, so they are not old enough to be removed.
+func prunePDFCache() {
+	entries, err := os.ReadDir(pdfCacheDir())
+	if err != nil {
+		logErrorf("Error reading PDF cache directory: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-cfg.PDFCacheTTL)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		log.Printf("Evicting cached PDF %s", entry.Name())
+		os.Remove(filepath.Join(pdfCacheDir(), entry.Name()))
+		pdfPageCounts.Delete(strings.TrimSuffix(entry.Name(), ".pdf"))
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows a gzip response
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipPDF returns the path of a gzip compressed copy of the cached PDF, creating it on first use.
+// It reports false when the copy would not save at least a tenth of the size, so already
+// compact PDFs are sent as they are.
+func gzipPDF(path string) (string, bool) {
+	gzPath := path + ".gz"
+	unlock := pdfCacheLocks.lock(gzPath)
+	defer unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+	gzInfo, err := os.Stat(gzPath)
+	if err != nil {
+		if gzInfo, err = writeGzipFile(path, gzPath); err != nil {
+			logErrorf("Failed to compress cached PDF %s: %v", path, err)
+			return "", false
+		}
+	}
+	return gzPath, gzInfo.Size() < info.Size()*9/10
+}
+
+// writeGzipFile compresses src into dst, replacing dst atomically
+func writeGzipFile(src, dst string) (os.FileInfo, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	tmpPath := dst + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath) // No-op after the rename
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return nil, err
+	}
+	return os.Stat(dst)
+}
+
+// servePDFFile serves a cached PDF via http.ServeContent, which handles Range, If-Range and conditional requests.
+// Clients accepting gzip get the compressed copy when it is meaningfully smaller; ranges then
+// apply to the compressed bytes, which carry their own ETag.
+func servePDFFile(w http.ResponseWriter, r *http.Request, path, hash string) {
+	etag, compressed := hash, false
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		if gzPath, ok := gzipPDF(path); ok {
+			path, etag, compressed = gzPath, hash+"-gzip", true
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "PDF not found", http.StatusNotFound)
+		} else {
+			logErrorf("Failed to open cached PDF %s: %v", path, err)
+			http.Error(w, "Failed to retrieve generated PDF", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		logErrorf("Failed to stat cached PDF %s: %v", path, err)
+		http.Error(w, "Failed to retrieve generated PDF", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", "underlog.pdf"))
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Content-Location", cfg.BasePath+"/pdf/"+hash) // Where the PDF can be re-fetched (and resumed) with GET
+	if compressed {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	http.ServeContent(w, r, "underlog.pdf", info.ModTime(), f)
+}
+
+// PDFJSONResponse is returned by /pdf when the client prefers application/json
+type PDFJSONResponse struct {
+	Filename  string `json:"filename"`
+	Pages     int    `json:"pages"`
+	Bytes     int64  `json:"bytes"` // Size of the decoded PDF
+	PDFBase64 string `json:"pdf_base64"`
+}
+
+// prefersJSON reports whether the Accept header ranks application/json above the endpoint's
+// default media type. A missing header or */* keeps the default.
+func prefersJSON(r *http.Request, defaultType string) bool {
+	defaultMajor, _, _ := strings.Cut(defaultType, "/")
+	jsonQ, defaultQ := 0.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case defaultType, defaultMajor + "/*", "*/*":
+			defaultQ = max(defaultQ, q)
+		}
+	}
+	return jsonQ > defaultQ
+}
+
+// writePDFJSON sends the cached PDF base64 encoded inside a JSON object.
+// It streams the base64 directly from the file, producing the same JSON as encoding PDFJSONResponse.
+func writePDFJSON(w http.ResponseWriter, path string, pages int) {
+	f, err := os.Open(path)
+	if err != nil {
+		logErrorf("Failed to open cached PDF %s: %v", path, err)
+		http.Error(w, "Failed to retrieve generated PDF", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		logErrorf("Failed to stat cached PDF %s: %v", path, err)
+		http.Error(w, "Failed to retrieve generated PDF", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept")
+	fmt.Fprintf(w, `{"filename":"underlog.pdf","pages":%d,"bytes":%d,"pdf_base64":"`, pages, info.Size())
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(enc, f); err != nil {
+		logErrorf("Error streaming PDF %s as JSON: %v", path, err)
+		return
+	}
+	enc.Close()
+	io.WriteString(w, "\"}\n")
+}
+
+// POST /pdf (Public) - Rewritten PDF Handler
+func pdfHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 1. Read and decode the JSON request body
+	bodyBytes, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Request body exceeds the limit of %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logErrorf("Error reading PDF request body: %v", err)
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var pdfReq PDFRequest
+	if err := json.Unmarshal(bodyBytes, &pdfReq); err != nil {
+		logErrorf("Error decoding PDF request JSON: %v. Body: %s", err, string(bodyBytes))
+		http.Error(w, "Invalid JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if pdfReq.Input == "" {
+		log.Println("PDF request received with empty SVG input")
+		http.Error(w, "SVG input is required", http.StatusBadRequest)
+		return
+	}
+	pages, err := validateSVGInput(pdfReq.Input)
+	if err != nil {
+		log.Printf("PDF request rejected, input is not SVG: %v", err)
+		http.Error(w, "Input is not valid SVG: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// 2. Generate the PDF (or reuse the cached copy for identical input)
+	if pdfReq.Page < 0 {
+		http.Error(w, "Page must be a positive page number", http.StatusBadRequest)
+		return
+	}
+
+	pdfPath, hash, err := cachedPDF(r.Context(), pdfReq.Input, pdfReq.Page)
+	if err != nil {
+		var pe *pdfError
+		if errors.As(err, &pe) && errors.Is(err, errPageNotFound) {
+			http.Error(w, pe.Message, http.StatusNotFound)
+		} else if pe != nil {
+			http.Error(w, pe.Message, http.StatusInternalServerError)
+		} else {
+			http.Error(w, "Failed to generate PDF", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	recordAudit(r, sessionUserID(r), auditActionPDFGenerate, 0)
+
+	// 3. Send the PDF to the client, as binary or base64 JSON depending on Accept
+	if pdfReq.Page > 0 {
+		pages = 1
+	}
+	sendPDF(w, r, pdfPath, hash, pages)
+}
+
+// sendPDF answers a PDF generation request with the cached PDF, as binary or base64 JSON depending on Accept.
+// The page count is read from the PDF itself; expectedPages is reported when Ghostscript can't tell.
+func sendPDF(w http.ResponseWriter, r *http.Request, pdfPath, hash string, expectedPages int) {
+	pages := cachedPDFPageCount(r.Context(), pdfPath, hash)
+	if pages == 0 {
+		pages = expectedPages
+	}
+	w.Header().Set("X-PDF-Page-Count", strconv.Itoa(pages))
+	if prefersJSON(r, "application/pdf") {
+		writePDFJSON(w, pdfPath, pages)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	servePDFFile(w, r, pdfPath, hash)
+}
+
+// renderProjectSVG runs UNDERLOG_RENDER_COMMAND in a work directory holding the project as
+// body.txt and images/<name>, and returns the SVG it writes to stdout. The web client renders
+// with browser APIs (canvas text metrics), so the command is typically a headless browser script.
+func renderProjectSVG(ctx context.Context, body string, images map[string][]byte) (string, error) {
+	tempDir, err := os.MkdirTemp("", pdfTempDirPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := writeProjectWorkDir(tempDir, "body.txt", body, images); err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := pdfToolCommand(ctx, tempDir, "bash", "-c", cfg.RenderCommand)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// writeProjectWorkDir writes a project into dir as bodyFile and images/<name> for an external renderer
+func writeProjectWorkDir(dir, bodyFile, body string, images map[string][]byte) error {
+	if err := os.WriteFile(filepath.Join(dir, bodyFile), []byte(body), 0600); err != nil {
+		return err
+	}
+	if err := os.Mkdir(filepath.Join(dir, "images"), 0700); err != nil {
+		return err
+	}
+	for name, blob := range images {
+		if name != filepath.Base(name) || name == ".." {
+			continue // Stored before image names were validated; never write outside the directory
+		}
+		if err := os.WriteFile(filepath.Join(dir, "images", name), blob, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedMarkdownPDF returns the cached PDF of a Markdown project, running UNDERLOG_MARKDOWN_PDF_COMMAND
+// in a work directory holding body.md and images/<name> if it is not cached yet
+func cachedMarkdownPDF(ctx context.Context, body string, images map[string][]byte) (string, string, error) {
+	key := markdownContentType + "\x00" + body
+	for _, name := range slices.Sorted(maps.Keys(images)) {
+		key += "\x00" + name + "=" + contentHash(images[name])
+	}
+	return cachedPDFFile(key, func(destPath string) error {
+		tempDir, err := os.MkdirTemp("", pdfTempDirPrefix)
+		if err != nil {
+			return &pdfError{"Failed to process request (temp dir)", err}
+		}
+		defer os.RemoveAll(tempDir)
+
+		if err := writeProjectWorkDir(tempDir, "body.md", body, images); err != nil {
+			return &pdfError{"Failed to process request (write input)", err}
+		}
+		var stderr bytes.Buffer
+		cmd := pdfToolCommand(ctx, tempDir, "bash", "-c", cfg.MarkdownPDFCommand)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			logErrorf("Markdown PDF command failed: %v\nOutput: %s", err, stderr.String())
+			return &pdfError{"Failed to render Markdown to PDF", err}
+		}
+		if err := moveFile(filepath.Join(tempDir, "output.pdf"), destPath); err != nil {
+			return &pdfError{"Markdown renderer did not produce output.pdf", err}
+		}
+		return nil
+	})
+}
+
+// psStringEscaper quotes text for a PostScript (string) literal
+var psStringEscaper = strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+
+// pdfFilePageCount asks Ghostscript for the number of pages in a PDF, returning 0 if it can't tell.
+// Ghostscript stays in SAFER mode with read access to just that one file.
+func pdfFilePageCount(ctx context.Context, path string) int {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		logWarnf("Could not count pages of %s: %v", path, err)
+		return 0
+	}
+	var stdout bytes.Buffer
+	cmd := pdfToolCommand(ctx, filepath.Dir(path), "gs", "-q", "-dNODISPLAY", "-dSAFER", "--permit-file-read="+path,
+		"-c", fmt.Sprintf("(%s) (r) file runpdfbegin pdfpagecount = quit", psStringEscaper.Replace(path)))
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		logWarnf("Could not count pages of %s: %v", path, err)
+		return 0
+	}
+	pages, _ := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	return pages
+}
+
+// POST /api/projects/{id}/pdf (Authenticated)
+// Renders the stored project to PDF according to its content type: SVG projects are rendered to
+// SVG with UNDERLOG_RENDER_COMMAND and run through the /pdf pipeline, Markdown projects go through
+// UNDERLOG_MARKDOWN_PDF_COMMAND (Markdown to HTML to PDF). Answers 501 when the renderer is not configured.
+func projectPDFHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var body, contentType string
+	var images map[string][]byte
+	dbMutex.Lock()
+	err := db.QueryRow("SELECT content_type, body FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&contentType, (*storedBody)(&body))
+	if err == nil {
+		images, err = storedProjectImages(projectID)
+	}
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error loading project %d for PDF rendering: %v", projectID, err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	switch contentType {
+	case svgContentType:
+		if cfg.RenderCommand == "" {
+			http.Error(w, "Server-side rendering is not configured (UNDERLOG_RENDER_COMMAND); send rendered SVG to /pdf instead", http.StatusNotImplemented)
+			return
+		}
+	case markdownContentType:
+		if cfg.MarkdownPDFCommand == "" {
+			http.Error(w, "Markdown PDF rendering is not configured (UNDERLOG_MARKDOWN_PDF_COMMAND)", http.StatusNotImplemented)
+			return
+		}
+		pdfPath, hash, err := cachedMarkdownPDF(r.Context(), body, images)
+		if err != nil {
+			var pe *pdfError
+			if errors.As(err, &pe) {
+				http.Error(w, pe.Message, http.StatusInternalServerError)
+			} else {
+				http.Error(w, "Failed to generate PDF", http.StatusInternalServerError)
+			}
+			return
+		}
+		recordAudit(r, userID, auditActionPDFGenerate, projectID)
+		sendPDF(w, r, pdfPath, hash, 0)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("PDF generation is not supported for %s projects", contentType), http.StatusUnprocessableEntity)
+		return
+	}
+
+	svg, err := renderProjectSVG(r.Context(), body, images)
+	if err != nil {
+		logErrorf("Error rendering project %d to SVG: %v", projectID, err)
+		http.Error(w, "Failed to render project", http.StatusInternalServerError)
+		return
+	}
+	pages, err := validateSVGInput(svg)
+	if err != nil {
+		logErrorf("Renderer produced invalid SVG for project %d: %v", projectID, err)
+		http.Error(w, "Failed to render project: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pdfPath, hash, err := cachedPDF(r.Context(), svg, 0)
+	if err != nil {
+		var pe *pdfError
+		if errors.As(err, &pe) {
+			http.Error(w, pe.Message, http.StatusInternalServerError)
+		} else {
+			http.Error(w, "Failed to generate PDF", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	recordAudit(r, userID, auditActionPDFGenerate, projectID)
+	sendPDF(w, r, pdfPath, hash, pages)
+}
+
+// SVGValidationReport is returned by /pdf/validate
+type SVGValidationReport struct {
+	Valid  bool     `json:"valid"`
+	Pages  int      `json:"pages"`
+	Errors []string `json:"errors"`
+}
+
+// POST /pdf/validate (Public)
+// Runs the input checks of /pdf without starting the PDF tools, so editors can flag problems inline
+func validatePDFHandler(w http.ResponseWriter, r *http.Request) {
+	var pdfReq PDFRequest
+	if err := json.NewDecoder(r.Body).Decode(&pdfReq); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body exceeds the limit of %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	report := SVGValidationReport{Errors: []string{}}
+	pages, err := validateSVGInput(pdfReq.Input)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else {
+		report.Pages = pages
+	}
+	report.Valid = err == nil
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// GET, HEAD /pdf/{hash} (Public)
+// Re-fetches a previously generated PDF; supports Range requests for resuming downloads
+func getCachedPDFHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		http.Error(w, "Invalid PDF identifier", http.StatusBadRequest)
+		return
+	}
+	servePDFFile(w, r, pdfCachePath(hash), hash)
+}
+
+// POST /odt (Public)
+func odtHandler(w http.ResponseWriter, r *http.Request) {
+	// TODO: Implement actual ODT generation logic
+	log.Println("ODT endpoint called (not implemented)")
+	http.Error(w, "ODT generation not implemented", http.StatusNotImplemented)
+}
+
+// maxRecentWindow caps how far back ?updated_since / ?days may reach
+const maxRecentWindow = 365 * 24 * time.Hour
+
+// updatedSinceParam parses ?updated_since=<RFC3339> or ?days=<n> into a lower bound for
+// updated_at. The zero time means no filter was requested.
+func updatedSinceParam(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	query := r.URL.Query()
+	sinceValue, daysValue := query.Get("updated_since"), query.Get("days")
+	if sinceValue != "" && daysValue != "" {
+		http.Error(w, "Use either updated_since or days, not both", http.StatusBadRequest)
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	var since time.Time
+	switch {
+	case sinceValue != "":
+		t, err := time.Parse(time.RFC3339, sinceValue)
+		if err != nil {
+			http.Error(w, "Invalid updated_since, expected an RFC3339 timestamp", http.StatusBadRequest)
+			return time.Time{}, false
+		}
+		since = t
+	case daysValue != "":
+		maxDays := int(maxRecentWindow / (24 * time.Hour))
+		n, err := strconv.Atoi(daysValue)
+		if err != nil || n < 1 || n > maxDays {
+			http.Error(w, fmt.Sprintf("Invalid days, expected 1-%d", maxDays), http.StatusBadRequest)
+			return time.Time{}, false
+		}
+		since = now.AddDate(0, 0, -n)
+	default:
+		return time.Time{}, true
+	}
+
+	if now.Sub(since) > maxRecentWindow {
+		http.Error(w, fmt.Sprintf("updated_since must be within the last %d days", int(maxRecentWindow/(24*time.Hour))), http.StatusBadRequest)
+		return time.Time{}, false
+	}
+	return since, true
+}
+
+// timeQueryParam parses an optional RFC3339 query parameter; the zero time means it was not given
+func timeQueryParam(w http.ResponseWriter, r *http.Request, name string) (time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s, expected an RFC3339 timestamp", name), http.StatusBadRequest)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// updatedRangeParams parses ?updated_after= and ?updated_before= into inclusive bounds for updated_at
+func updatedRangeParams(w http.ResponseWriter, r *http.Request) (after, before time.Time, ok bool) {
+	if after, ok = timeQueryParam(w, r, "updated_after"); !ok {
+		return
+	}
+	if before, ok = timeQueryParam(w, r, "updated_before"); !ok {
+		return
+	}
+	if !after.IsZero() && !before.IsZero() && after.After(before) {
+		http.Error(w, "updated_after must not be later than updated_before", http.StatusBadRequest)
+		return after, before, false
+	}
+	return after, before, true
+}
+
+// GET /api/projects (Authenticated)
+// Archived projects are only listed with ?include_archived=true.
+// ?updated_since=<RFC3339> or ?days=<n> limits the list to recently edited projects.
+// ?updated_after= and ?updated_before= (RFC3339, inclusive) restrict it to a time window.
+func getProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+
+	since, ok := updatedSinceParam(w, r)
+	if !ok {
+		return
+	}
+	after, before, ok := updatedRangeParams(w, r)
+	if !ok {
+		return
+	}
+	if after.IsZero() || after.Before(since) {
+		after = since // updated_since/days and updated_after are both lower bounds; the later one wins
+	}
+
+	dbMutex.Lock()
+	includeArchived, _ := strconv.ParseBool(r.URL.Query().Get("include_archived"))
+	// datetime() normalizes both CURRENT_TIMESTAMP values from the trigger and Go-written timestamps to UTC
+	rows, err := db.Query(
+		`SELECT id, name, archived FROM projects WHERE user_id = ? AND (archived = 0 OR ?)
+		AND (? OR datetime(updated_at) >= datetime(?)) AND (? OR datetime(updated_at) <= datetime(?))
+		ORDER BY updated_at DESC`,
+		userID, includeArchived,
+		after.IsZero(), after.UTC().Format("2006-01-02 15:04:05"),
+		before.IsZero(), before.UTC().Format("2006-01-02 15:04:05"),
+	)
+	dbMutex.Unlock()
+
+	if err != nil {
+		logErrorf("Error querying projects for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve projects", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	projects := []ProjectListItem{}
+	for rows.Next() {
+		var p ProjectListItem
+		if err := rows.Scan(&p.ID, &p.Name, &p.Archived); err != nil {
+			logErrorf("Error scanning project row for user %d: %v", userID, err)
+			http.Error(w, "Failed to process projects", http.StatusInternalServerError)
+			return
+		}
+		projects = append(projects, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		logErrorf("Error iterating project rows for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve projects", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+// POST /api/projects (Authenticated)
+func createProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+
+	var req CreateProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if !checkBodySize(w, req.Body) {
+		return
+	}
+
+	var validation ValidationErrors
+	projectName, err := validateProjectName(req.Name)
+	validation.check("name", err)
+	validation.check("content_type", validateProjectContentType(req.ContentType))
+	if validation.respond(w) {
+		return
+	}
+	if projectName == "" {
+		projectName = defaultProjectName // Or require a name from the client
+	}
+	if req.ContentType == "" {
+		req.ContentType = svgContentType
+	}
+	if req.Body == "" {
+		req.Body = projectBodyTemplate(userID, req.ContentType)
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	// Check if project name already exists for this user
+	var existingID int64
+	err = db.QueryRow("SELECT id FROM projects WHERE user_id = ? AND name = ?", userID, projectName).Scan(&existingID)
+	if err == nil {
+		http.Error(w, "Project name already exists", http.StatusConflict)
+		return
+	}
+	var collision string
+	if err == sql.ErrNoRows {
+		collision, err = findCaseCollision(db, projectName, "SELECT name FROM projects WHERE user_id = ?", userID)
+	}
+	if err != nil {
+		logErrorf("Error checking for existing project '%s' for user %d: %v", projectName, userID, err)
+		http.Error(w, "Failed to create project", dbErrorStatus(err))
+		return
+	}
+	if collision != "" {
+		http.Error(w, fmt.Sprintf("Project name differs from existing project %q only in case", collision), http.StatusConflict)
+		return
+	}
+	if !checkUserQuota(w, userID, int64(len(req.Body))) {
+		return
+	}
+
+	var result sql.Result
+	sealed, err := sealBody(req.Body)
+	if err == nil {
+		result, err = db.ExecContext(r.Context(),
+			"INSERT INTO projects (user_id, name, content_type, body, updated_at) VALUES (?, ?, ?, ?, ?)",
+			userID, projectName, req.ContentType, sealed, time.Now(),
+		)
+	}
+	if err != nil {
+		logErrorf("Error inserting new project '%s' for user %d: %v", projectName, userID, err)
+		http.Error(w, "Failed to create project", dbErrorStatus(err))
+		return
+	}
+
+	projectID, err := result.LastInsertId()
+	if err != nil {
+		logErrorf("Error getting last insert ID for project '%s', user %d: %v", projectName, userID, err)
+		// Project was created, but we can't return the ID easily. Log and maybe return 201 without ID.
+		http.Error(w, "Project created but failed to retrieve ID", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created project ID %d ('%s') for user %d", projectID, projectName, userID)
+	go notifyWebhooks(userID, webhookEventProjectCreated, projectID, projectName)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Project created successfully",
+		"projectId": projectID,
+		"name":      projectName,
+	})
+}
+
+// GET /api/projects/{id} (Authenticated)
+// Honors If-Modified-Since against the project's updated_at
+// ?include=images embeds each image as base64, gzip-compressed per image with ?image_encoding=gzip
+func getProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	vars := mux.Vars(r)
+	projectIDStr := vars["id"]
+	projectID, err := strconv.ParseInt(projectIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	logDebugf("Fetching project %d for user %d", projectID, userID)
+
+	// ?include=images embeds the blobs; ?image_encoding=gzip compresses each one that shrinks
+	includeImages := r.URL.Query().Get("include") == "images"
+	gzipImages := false
+	switch encoding := r.URL.Query().Get("image_encoding"); encoding {
+	case "", "base64":
+	case "gzip":
+		gzipImages = true
+	default:
+		http.Error(w, "Invalid image_encoding, expected base64 or gzip", http.StatusBadRequest)
+		return
+	}
+
+	if entry, ok := projectCache.get(projectID); ok && entry.userID == userID && !includeImages {
+		logDebugf("Serving project %d from cache", projectID)
+		if !checkNotModified(w, r, entry.lastModified) {
+			recordAudit(r, userID, auditActionProjectRead, projectID)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(entry.body)
+		}
+		return
+	}
+
+	var project ProjectDetail
+	project.ID = projectID
+
+	// Only the rows are read under the lock; embedded image bytes are loaded after releasing it
+	var updatedAt time.Time
+	var images []projectImageRef
+	dbMutex.Lock()
+	generation := projectCache.generation(projectID)
+	err = db.QueryRow("SELECT name, content_type, body, updated_at FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&project.Name, &project.ContentType, (*storedBody)(&project.Body), &updatedAt)
+	if err == nil {
+		images, err = projectImageRefs(projectID)
+	}
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("Project %d not found or does not belong to user %d", projectID, userID)
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error fetching project %d details for user %d: %v", projectID, userID, err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	lastModified := updatedAt.UTC().Truncate(time.Second)
+	if checkNotModified(w, r, lastModified) {
+		return
+	}
+
+	project.ImageNames = []string{}
+	var storedBytes int64
+	for _, img := range images {
+		project.ImageNames = append(project.ImageNames, img.name)
+		if img.url != "" {
+			if project.ImageURLs == nil {
+				project.ImageURLs = make(map[string]string)
+			}
+			project.ImageURLs[img.name] = img.url
+		}
+		storedBytes += img.size
+	}
+
+	if includeImages {
+		if cfg.MaxEmbeddedImageBytes > 0 && storedBytes > cfg.MaxEmbeddedImageBytes {
+			http.Error(w, fmt.Sprintf("Project images total %d bytes, more than the %d that can be embedded; fetch them individually or as images.zip", storedBytes, cfg.MaxEmbeddedImageBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if project.Images, err = embedProjectImages(images, gzipImages); err != nil {
+			logErrorf("Error embedding images of project %d: %v", projectID, err)
+			http.Error(w, "Failed to retrieve project images", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	body, err := json.Marshal(project)
+	if err != nil {
+		logErrorf("Error encoding project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+	if !includeImages { // Only the plain detail is cached; embedded images would crowd it out
+		projectCache.put(projectCacheEntry{projectID: projectID, userID: userID, lastModified: lastModified, body: body, generation: generation})
+	}
+
+	recordAudit(r, userID, auditActionProjectRead, projectID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// projectImageRef locates one image of a project without loading its bytes
+type projectImageRef struct {
+	name string
+	key  string // Storage key, empty for external images
+	url  string // Set for external images
+	size int64
+}
+
+// projectImageRefs lists a project's images in name order. The caller must hold dbMutex.
+func projectImageRefs(projectID int64) ([]projectImageRef, error) {
+	rows, err := db.Query("SELECT name, COALESCE(storage_key, ''), COALESCE(url, ''), size FROM images WHERE project_id = ? ORDER BY name", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []projectImageRef
+	for rows.Next() {
+		var ref projectImageRef
+		if err := rows.Scan(&ref.name, &ref.key, &ref.url, &ref.size); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// embedProjectImages loads the images for a project response. With gzipImages each blob is
+// compressed when that makes it smaller, which pays off mostly for SVGs. It reads the image
+// store directly, so the caller should not hold dbMutex.
+func embedProjectImages(refs []projectImageRef, gzipImages bool) ([]ProjectImageData, error) {
+	images := make([]ProjectImageData, 0, len(refs))
+	for _, ref := range refs {
+		img := ProjectImageData{Name: ref.name}
+		if ref.key == "" {
+			img.URL = ref.url
+			images = append(images, img)
+			continue
+		}
+		blob, err := loadImage(ref.key)
+		if errors.Is(err, errImageNotStored) {
+			continue // Deleted since the rows were read
+		}
+		if err != nil {
+			return nil, err
+		}
+		if gzipImages {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(blob) // Writes to a bytes.Buffer don't fail
+			zw.Close()
+			if buf.Len() < len(blob) {
+				blob, img.Gzip = buf.Bytes(), true
+			}
+		}
+		img.BlobBase64 = base64.StdEncoding.EncodeToString(blob)
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// checkNotModified sets Last-Modified and answers 304 if the client's If-Modified-Since is current.
+// SQLite timestamps have second resolution, so lastModified should be truncated to seconds.
+func checkNotModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+const maxBatchProjects = 100
+
+type BatchProjectsRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+// BatchProjectsResponse lists the requested projects; Missing holds IDs that don't exist or belong to another user
+type BatchProjectsResponse struct {
+	Projects []ProjectDetail `json:"projects"`
+	Missing  []int64         `json:"missing"`
+}
+
+// POST /api/projects/batch (Authenticated)
+func batchProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+
+	var req BatchProjectsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(req.IDs) == 0 || len(req.IDs) > maxBatchProjects {
+		http.Error(w, fmt.Sprintf("Between 1 and %d project IDs are required", maxBatchProjects), http.StatusBadRequest)
+		return
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(req.IDs)), ",")
+	args := make([]interface{}, 0, len(req.IDs)+1)
+	for _, id := range req.IDs {
+		args = append(args, id)
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	rows, err := db.Query(
+		"SELECT id, name, body FROM projects WHERE id IN ("+placeholders+") AND user_id = ?",
+		append(args, userID)...,
+	)
+	if err != nil {
+		logErrorf("Error querying project batch for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve projects", http.StatusInternalServerError)
+		return
+	}
+	found := make(map[int64]*ProjectDetail)
+	for rows.Next() {
+		p := &ProjectDetail{ImageNames: []string{}}
+		if err := rows.Scan(&p.ID, &p.Name, (*storedBody)(&p.Body)); err != nil {
+			rows.Close()
+			logErrorf("Error scanning project batch row for user %d: %v", userID, err)
+			http.Error(w, "Failed to retrieve projects", http.StatusInternalServerError)
+			return
+		}
+		found[p.ID] = p
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT project_id, name, COALESCE(url, '') FROM images WHERE project_id IN ("+placeholders+") ORDER BY name", args...)
+	if err != nil {
+		logErrorf("Error querying image names for project batch of user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve project images", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var projectID int64
+		var name, url string
+		if err := rows.Scan(&projectID, &name, &url); err != nil {
+			logErrorf("Error scanning image name for project batch of user %d: %v", userID, err)
+			http.Error(w, "Failed to retrieve project images", http.StatusInternalServerError)
+			return
+		}
+		if p, ok := found[projectID]; ok { // Skips images of projects owned by someone else
+			p.ImageNames = append(p.ImageNames, name)
+			if url != "" {
+				if p.ImageURLs == nil {
+					p.ImageURLs = make(map[string]string)
+				}
+				p.ImageURLs[name] = url
+			}
+		}
+	}
+
+	// Answer in request order, listing each ID once
+	resp := BatchProjectsResponse{Projects: []ProjectDetail{}, Missing: []int64{}}
+	seen := make(map[int64]bool)
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if p, ok := found[id]; ok {
+			resp.Projects = append(resp.Projects, *p)
+		} else {
+			resp.Missing = append(resp.Missing, id)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ProjectBody is the JSON form of GET /api/projects/{id}/body
+type ProjectBody struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Body      string    `json:"body"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GET /api/projects/{id}/body (Authenticated)
+// Returns only the project body as plain text, for piping into other tools, or as a ProjectBody
+// when the client prefers application/json. Unlike the project detail it skips the image list.
+func getProjectBodyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var name, body string
+	var updatedAt time.Time
+	dbMutex.Lock()
+	err := db.QueryRow("SELECT name, body, updated_at FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&name, (*storedBody)(&body), &updatedAt)
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error fetching body of project %d for user %d: %v", projectID, userID, err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if checkNotModified(w, r, updatedAt.UTC().Truncate(time.Second)) {
+		return
+	}
+	recordAudit(r, userID, auditActionProjectRead, projectID)
+	w.Header().Add("Vary", "Accept")
+	if prefersJSON(r, "text/plain") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ProjectBody{ID: projectID, Name: name, Body: body, UpdatedAt: updatedAt})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.txt\"", safeFileName(name)))
+	io.WriteString(w, body)
+}
+
+// ProjectStats summarizes one project without sending its body or images
+type ProjectStats struct {
+	BodyBytes       int       `json:"body_bytes"`
+	ImageCount      int64     `json:"image_count"`
+	TotalImageBytes int64     `json:"total_image_bytes"`
+	PageCount       *int      `json:"page_count"` // Pages of the rendered SVG; null unless UNDERLOG_RENDER_COMMAND renders the project
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// GET /api/projects/{id}/stats (Authenticated)
+func getProjectStatsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var stats ProjectStats
+	var body string
+	var images map[string][]byte
+	dbMutex.Lock()
+	var contentType string
+	err := db.QueryRow("SELECT content_type, body, updated_at FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&contentType, (*storedBody)(&body), &stats.UpdatedAt)
+	if err == nil {
+		err = db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images WHERE project_id = ?", projectID).Scan(&stats.ImageCount, &stats.TotalImageBytes)
+	}
+	renderable := contentType == svgContentType && cfg.RenderCommand != ""
+	if err == nil && renderable {
+		images, err = storedProjectImages(projectID)
+	}
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error computing stats of project %d for user %d: %v", projectID, userID, err)
+			http.Error(w, "Failed to retrieve project stats", http.StatusInternalServerError)
+		}
+		return
+	}
+	stats.BodyBytes = len(body)
+	if renderable {
+		if pages, err := renderedPageCount(r.Context(), body, images); err != nil {
+			logWarnf("Could not count pages of project %d: %v", projectID, err)
+		} else {
+			stats.PageCount = &pages
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// renderedPageCount renders a project with UNDERLOG_RENDER_COMMAND and counts the pages of the
+// resulting SVG. Stored bodies are client markup, so their pages are only known after rendering.
+func renderedPageCount(ctx context.Context, body string, images map[string][]byte) (int, error) {
+	svg, err := renderProjectSVG(ctx, body, images)
+	if err != nil {
+		return 0, err
+	}
+	return svgRootPages(svg)
+}
+
+// svgRootPages counts the top-level <svg> documents in an SVG body, one per page. It parses the
+// body as XML, so nested <svg> elements are not counted and malformed bodies, non-<svg> roots and
+// bodies without any <svg> are reported as errors. Project stats and pages, /pdf and validation all
+// count pages with it.
+func svgRootPages(body string) (int, error) {
+	return walkSVGPages(body, nil)
+}
+
+// walkSVGPages is svgRootPages with inspect called on every token, so validateSVGInput can
+// reject content in the same pass. An error from inspect stops the walk and is returned.
+func walkSVGPages(body string, inspect func(xml.Token) error) (int, error) {
+	decoder := xml.NewDecoder(strings.NewReader(body))
+	decoder.Entity = xml.HTMLEntity
+	depth, pages := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if inspect != nil {
+			if err := inspect(token); err != nil {
+				return 0, err
+			}
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				if t.Name.Local != "svg" {
+					return 0, fmt.Errorf("expected an <svg> root element, found <%s>", t.Name.Local)
+				}
+				pages++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(t)) > 0 {
+				return 0, errors.New("text outside of an <svg> element")
+			}
+		}
+	}
+	if pages == 0 {
+		return 0, errors.New("no <svg> element found")
+	}
+	return pages, nil
+}
+
+// GET /api/projects/{id}/pages (Authenticated)
+// Number of pages the project renders to, without downloading it. Renders with UNDERLOG_RENDER_COMMAND
+// like /api/projects/{id}/pdf and answers 501 when that is not configured.
+func getProjectPagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if cfg.RenderCommand == "" {
+		http.Error(w, "Server-side rendering is not configured (UNDERLOG_RENDER_COMMAND)", http.StatusNotImplemented)
+		return
+	}
+
+	var body, contentType string
+	var images map[string][]byte
+	dbMutex.Lock()
+	err := db.QueryRow("SELECT content_type, body FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&contentType, (*storedBody)(&body))
+	if err == nil {
+		images, err = storedProjectImages(projectID)
+	}
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error fetching body of project %d for user %d: %v", projectID, userID, err)
+			http.Error(w, "Failed to count project pages", http.StatusInternalServerError)
+		}
+		return
+	}
+	if contentType != svgContentType {
+		http.Error(w, fmt.Sprintf("Page counts are only available for %s projects, this project is %s", svgContentType, contentType), http.StatusUnprocessableEntity)
+		return
+	}
+
+	pages, err := renderedPageCount(r.Context(), body, images)
+	if err != nil {
+		logErrorf("Error counting pages of project %d: %v", projectID, err)
+		http.Error(w, "Failed to render project", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"pages": pages})
+}
+
+type ValidateProjectRequest struct {
+	Body *string `json:"body"` // Validated instead of the stored body when set
+	SVG  string  `json:"svg"`  // Optional rendered SVG, checked as /pdf would check it
+}
+
+// ProjectValidationReport lists the problems found before an export
+type ProjectValidationReport struct {
+	Valid         bool     `json:"valid"`
+	MissingImages []string `json:"missing_images,omitempty"` // Referenced by image:: lines but not in the project
+	Errors        []string `json:"errors,omitempty"`         // Problems parsing the rendered SVG
+}
+
+// POST /api/projects/{id}/validate (Authenticated)
+// Pre-flight check for exports: every image the body references must exist in the project, and
+// the rendered SVG, if sent, must be well-formed. Never runs the PDF tools.
+func validateProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req ValidateProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF { // An empty request validates the stored body
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var body string
+	images := make(map[string]bool)
+	dbMutex.Lock()
+	err := db.QueryRow("SELECT body FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan((*storedBody)(&body))
+	var rows *sql.Rows
+	if err == nil {
+		rows, err = db.Query("SELECT name FROM images WHERE project_id = ?", projectID)
+	}
+	if err == nil {
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				break
+			}
+			images[name] = true
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+	}
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error loading project %d for validation: %v", projectID, err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+	if req.Body != nil {
+		body = *req.Body
+	}
+
+	report := ProjectValidationReport{}
+	for _, name := range bodyImageReferences(body) {
+		if !images[name] {
+			report.MissingImages = append(report.MissingImages, name)
+		}
+	}
+	if req.SVG != "" {
+		if _, err := validateSVGInput(req.SVG); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	report.Valid = len(report.MissingImages) == 0 && len(report.Errors) == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// renameImageReferences points the image lines of a body that name a key of renames at its value
+func renameImageReferences(body string, renames map[string]string) string {
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		rest, ok := strings.CutPrefix(line, "image::")
+		if !ok {
+			continue
+		}
+		name, caption := rest, ""
+		if j := strings.Index(rest, "["); j >= 0 {
+			name, caption = rest[:j], rest[j:]
+		}
+		if newName, ok := renames[strings.TrimSpace(name)]; ok {
+			lines[i] = "image::" + newName + caption
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// bodyImageReferences returns the distinct image names a body references, in order of first use.
+// Mirrors the client tokenizer: a line starting with "image::" names the image up to "[".
+func bodyImageReferences(body string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(body, "\n") {
+		rest, ok := strings.CutPrefix(line, "image::")
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, "["); i >= 0 {
+			rest = rest[:i]
+		}
+		name := strings.TrimSpace(rest)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type ProjectDiffRequest struct {
+	Body string `json:"body"`
+}
+
+// ProjectDiff compares a candidate body against the stored one
+type ProjectDiff struct {
+	Changed   bool   `json:"changed"`
+	Additions int    `json:"additions"` // Lines only in the candidate body
+	Deletions int    `json:"deletions"` // Lines only in the stored body
+	Unified   string `json:"unified"`   // Unified diff from the stored body to the candidate
+}
+
+// POST /api/projects/{id}/diff (Authenticated)
+// Diffs a client-supplied body against the stored one, e.g. to show unsaved changes
+func diffProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req ProjectDiffRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if !checkBodySize(w, req.Body) {
+		return
+	}
+
+	var stored string
+	dbMutex.Lock()
+	err := db.QueryRow("SELECT body FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan((*storedBody)(&stored))
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error fetching body of project %d for diff: %v", projectID, err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+	if len(stored) > maxComparedBodyBytes || len(req.Body) > maxComparedBodyBytes {
+		http.Error(w, fmt.Sprintf("Bodies larger than %d bytes are not diffed", maxComparedBodyBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffBodies("stored", "candidate", stored, req.Body))
+}
+
+// diffBodies computes a line diff between two project bodies
+func diffBodies(fromLabel, toLabel, from, to string) ProjectDiff {
+	edits := myers.ComputeEdits(span.URIFromPath("body"), from, to)
+	unified := gotextdiff.ToUnified(fromLabel, toLabel, from, edits)
+
+	result := ProjectDiff{Changed: from != to, Unified: fmt.Sprint(unified)}
+	for _, hunk := range unified.Hunks {
+		for _, line := range hunk.Lines {
+			switch line.Kind {
+			case gotextdiff.Insert:
+				result.Additions++
+			case gotextdiff.Delete:
+				result.Deletions++
+			}
+		}
+	}
+	return result
+}
+
+// Bodies larger than this are not text-diffed, which is quadratic at worst
+const maxComparedBodyBytes = 1 << 20
+
+// ProjectComparison compares two projects of the same user
+type ProjectComparison struct {
+	A               int64           `json:"a"`
+	B               int64           `json:"b"`
+	NameChanged     bool            `json:"name_changed"`
+	BodyDiff        *ProjectDiff    `json:"body_diff,omitempty"`         // Diff from the body of A to the body of B
+	BodyDiffSkipped bool            `json:"body_diff_skipped,omitempty"` // A body exceeds maxComparedBodyBytes
+	OnlyInA         []string        `json:"only_in_a"`
+	OnlyInB         []string        `json:"only_in_b"`
+	Shared          []ComparedImage `json:"shared"`
+}
+
+// ComparedImage is an image name present in both compared projects
+type ComparedImage struct {
+	Name      string `json:"name"`
+	Identical bool   `json:"identical"` // Same content hash in both projects
+}
+
+// GET /api/projects/diff?a={id}&b={id} (Authenticated)
+// Compares two of the user's projects: names, a text diff of the bodies and the image names
+// only in one of them or shared, noting whether shared images have the same content
+func compareProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	a, ok := intQueryParam(w, r, "a", 0, 1, math.MaxInt)
+	if !ok {
+		return
+	}
+	b, ok := intQueryParam(w, r, "b", 0, 1, math.MaxInt)
+	if !ok {
+		return
+	}
+	if a == 0 || b == 0 {
+		http.Error(w, "Both a and b project IDs are required", http.StatusBadRequest)
+		return
+	}
+
+	var nameA, nameB, bodyA, bodyB string
+	var hashesA, hashesB map[string]string
+	dbMutex.Lock()
+	err := db.QueryRow("SELECT name, body FROM projects WHERE id = ? AND user_id = ?", a, userID).Scan(&nameA, (*storedBody)(&bodyA))
+	if err == nil {
+		err = db.QueryRow("SELECT name, body FROM projects WHERE id = ? AND user_id = ?", b, userID).Scan(&nameB, (*storedBody)(&bodyB))
+	}
+	if err == nil {
+		hashesA, err = projectImageHashes(int64(a))
+	}
+	if err == nil {
+		hashesB, err = projectImageHashes(int64(b))
+	}
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error loading projects %d and %d of user %d for comparison: %v", a, b, userID, err)
+			http.Error(w, "Failed to compare projects", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	result := ProjectComparison{
+		A:           int64(a),
+		B:           int64(b),
+		NameChanged: nameA != nameB,
+		OnlyInA:     []string{},
+		OnlyInB:     []string{},
+		Shared:      []ComparedImage{},
+	}
+	if len(bodyA) > maxComparedBodyBytes || len(bodyB) > maxComparedBodyBytes {
+		result.BodyDiffSkipped = true
+	} else {
+		diff := diffBodies(nameA, nameB, bodyA, bodyB)
+		result.BodyDiff = &diff
+	}
+	for _, name := range slices.Sorted(maps.Keys(hashesA)) {
+		if hashB, ok := hashesB[name]; ok {
+			result.Shared = append(result.Shared, ComparedImage{Name: name, Identical: hashesA[name] == hashB})
+		} else {
+			result.OnlyInA = append(result.OnlyInA, name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(hashesB)) {
+		if _, ok := hashesA[name]; !ok {
+			result.OnlyInB = append(result.OnlyInB, name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// projectImageHashes maps the image names of a project to their content hashes, or URLs for
+// external images. The caller must hold dbMutex.
+func projectImageHashes(projectID int64) (map[string]string, error) {
+	rows, err := db.Query("SELECT name, COALESCE(content_hash, url, '') FROM images WHERE project_id = ?", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var name, hash string
+		if err := rows.Scan(&name, &hash); err != nil {
+			return nil, err
+		}
+		hashes[name] = hash
+	}
+	return hashes, rows.Err()
+}
+
+// Bodies smaller than this are always snapshotted in full; deltas only pay off for larger bodies
+const minDeltaBodySize = 4096
+
+// ProjectVersion describes one stored snapshot of a project
+type ProjectVersion struct {
+	Version    int64     `json:"version"`
+	Size       int       `json:"size"` // Body length in bytes
+	ImageNames []string  `json:"image_names"`
+	Delta      bool      `json:"delta"` // Stored as a delta against an earlier full snapshot
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// recordProjectVersion snapshots the project's body and image names inside tx, unless they match
+// the latest version, then prunes versions beyond the retention count. Large bodies close to the
+// latest full snapshot are stored as a delta against it: the lengths of the shared prefix and
+// suffix plus the differing middle.
+func recordProjectVersion(ctx context.Context, tx *sql.Tx, projectID int64) error {
+	if cfg.VersionRetention <= 0 {
+		return nil
+	}
+
+	var body string
+	if err := tx.QueryRowContext(ctx, "SELECT body FROM projects WHERE id = ?", projectID).Scan((*storedBody)(&body)); err != nil {
+		return err
+	}
+	names := []string{}
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM images WHERE project_id = ? ORDER BY name", projectID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	namesJSON, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	var latest int64
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM project_versions WHERE project_id = ?", projectID).Scan(&latest); err != nil {
+		return err
+	}
+	if latest > 0 {
+		latestBody, latestNames, err := loadProjectVersion(ctx, tx, projectID, latest)
+		if err != nil {
+			return err
+		}
+		if latestBody == body && latestNames == string(namesJSON) {
+			return nil // Nothing changed since the last snapshot
+		}
+	}
+
+	stored, prefixLen, suffixLen := body, 0, 0
+	var baseVersion sql.NullInt64
+	if len(body) >= minDeltaBodySize {
+		var base int64
+		var baseBody string
+		err := tx.QueryRowContext(ctx,
+			"SELECT version, body FROM project_versions WHERE project_id = ? AND base_version IS NULL ORDER BY version DESC LIMIT 1",
+			projectID,
+		).Scan(&base, (*storedBody)(&baseBody))
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			prefix, suffix := commonAffixLengths(baseBody, body)
+			if middle := len(body) - prefix - suffix; middle < len(body)/2 {
+				stored, prefixLen, suffixLen = body[prefix:len(body)-suffix], prefix, suffix
+				baseVersion = sql.NullInt64{Int64: base, Valid: true}
+			}
+		}
+	}
+
+	version := latest + 1
+	sealed, err := sealBody(stored)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO project_versions (project_id, version, body, base_version, prefix_len, suffix_len, image_names, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		projectID, version, sealed, baseVersion, prefixLen, suffixLen, string(namesJSON), time.Now(),
+	); err != nil {
+		return err
+	}
+
+	// Older versions are dropped, except full snapshots that retained deltas are based on
+	cutoff := version - int64(cfg.VersionRetention)
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM project_versions WHERE project_id = ? AND version <= ? AND version NOT IN (
+			SELECT base_version FROM project_versions WHERE project_id = ? AND version > ? AND base_version IS NOT NULL)`,
+		projectID, cutoff, projectID, cutoff,
+	)
+	return err
+}
+
+// loadProjectVersion reconstructs the body of a stored version and returns it with the JSON
+// image name list. Returns sql.ErrNoRows when the version does not exist.
+func loadProjectVersion(ctx context.Context, tx *sql.Tx, projectID, version int64) (string, string, error) {
+	var stored, names string
+	var baseVersion sql.NullInt64
+	var prefixLen, suffixLen int
+	err := tx.QueryRowContext(ctx,
+		"SELECT body, base_version, prefix_len, suffix_len, image_names FROM project_versions WHERE project_id = ? AND version = ?",
+		projectID, version,
+	).Scan((*storedBody)(&stored), &baseVersion, &prefixLen, &suffixLen, &names)
+	if err != nil || !baseVersion.Valid {
+		return stored, names, err
+	}
+
+	var base string
+	if err := tx.QueryRowContext(ctx,
+		"SELECT body FROM project_versions WHERE project_id = ? AND version = ?", projectID, baseVersion.Int64,
+	).Scan((*storedBody)(&base)); err != nil {
+		return "", "", fmt.Errorf("loading base version %d: %w", baseVersion.Int64, err)
+	}
+	return base[:prefixLen] + stored + base[len(base)-suffixLen:], names, nil
+}
+
+// commonAffixLengths returns the byte lengths of the longest shared prefix and suffix of a and b,
+// never overlapping in either string
+func commonAffixLengths(a, b string) (int, int) {
+	limit := min(len(a), len(b))
+	prefix := 0
+	for prefix < limit && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < limit-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	return prefix, suffix
+}
+
+// GET /api/projects/{id}/versions (Authenticated)
+// Lists stored versions, newest first
+func getProjectVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if !requireProjectOwner(w, projectID, userID) {
+		return
+	}
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT version, base_version, prefix_len, suffix_len, "+plainBodyLength("body")+", image_names, created_at FROM project_versions WHERE project_id = ? ORDER BY version DESC",
+		projectID,
+	)
+	if err != nil {
+		logErrorf("Error listing versions of project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve versions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	versions := []ProjectVersion{}
+	for rows.Next() {
+		var v ProjectVersion
+		var baseVersion sql.NullInt64
+		var prefixLen, suffixLen int
+		var names string
+		if err := rows.Scan(&v.Version, &baseVersion, &prefixLen, &suffixLen, &v.Size, &names, &v.CreatedAt); err != nil {
+			logErrorf("Error scanning version of project %d: %v", projectID, err)
+			http.Error(w, "Failed to retrieve versions", http.StatusInternalServerError)
+			return
+		}
+		v.Delta = baseVersion.Valid
+		v.Size += prefixLen + suffixLen
+		if err := json.Unmarshal([]byte(names), &v.ImageNames); err != nil {
+			logErrorf("Error decoding image names of project %d version %d: %v", projectID, v.Version, err)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		logErrorf("Error iterating versions of project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve versions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// POST /api/projects/{id}/versions/{v}/restore (Authenticated)
+// Rolls the project body back to a stored version. Images are left as they are, since the blobs of
+// deleted images are not kept; the version's image names are returned so the client can re-add them.
+func restoreProjectVersionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.ParseInt(mux.Vars(r)["v"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	unlockProject := lockProject(projectID)
+	defer unlockProject()
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	var projectName string
+	err = db.QueryRow("SELECT name FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&projectName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error fetching project %d for restore: %v", projectID, err)
+			http.Error(w, "Failed to restore version", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var names string
+	err = withWriteTx(r.Context(), func(tx *sql.Tx) error {
+		body, versionNames, err := loadProjectVersion(r.Context(), tx, projectID, version)
+		if err != nil {
+			return err
+		}
+		names = versionNames
+		var bodyBytes int64
+		if err := tx.QueryRowContext(r.Context(), "SELECT "+plainBodyLength("body")+" FROM projects WHERE id = ?", projectID).Scan(&bodyBytes); err != nil {
+			return err
+		}
+		if err := userQuotaError(userID, int64(len(body))-bodyBytes); err != nil {
+			return err
+		}
+		sealed, err := sealBody(body)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(r.Context(), "UPDATE projects SET body = ?, updated_at = ? WHERE id = ?", sealed, time.Now(), projectID); err != nil {
+			return err
+		}
+		return recordProjectVersion(r.Context(), tx, projectID)
+	})
+	projectCache.invalidate(projectID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	var quotaErr *quotaExceededError
+	if errors.As(err, &quotaErr) {
+		http.Error(w, quotaErr.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logErrorf("Error restoring version %d of project %d: %v", version, projectID, err)
+		http.Error(w, "Failed to restore version", dbErrorStatus(err))
+		return
+	}
+
+	var imageNames []string
+	json.Unmarshal([]byte(names), &imageNames)
+
+	log.Printf("Restored project %d to version %d for user %d", projectID, version, userID)
+	go notifyWebhooks(userID, webhookEventProjectUpdated, projectID, projectName)
+	recordAuditAsync(r, userID, auditActionProjectUpdate, projectID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "Project restored successfully",
+		"version":     version,
+		"image_names": imageNames,
+	})
+}
+
+// DELETE /api/projects/{id} (Authenticated)
+func deleteProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	unlockProject := lockProject(projectID)
+	defer unlockProject()
+
+	dbMutex.Lock()
+	if !requireProjectOwner(w, projectID, userID) {
+		dbMutex.Unlock()
+		return
+	}
+	var projectName string
+	var imageKeys []string
+	err := db.QueryRow("SELECT name FROM projects WHERE id = ?", projectID).Scan(&projectName)
+	if err == nil {
+		imageKeys, err = projectImageKeys(projectID)
+	}
+	if err == nil {
+		// Images are removed by the ON DELETE CASCADE foreign key
+		_, err = db.ExecContext(r.Context(), "DELETE FROM projects WHERE id = ? AND user_id = ?", projectID, userID)
+	}
+	if err == nil {
+		releaseImageKeys(imageKeys)
+	}
+	projectCache.invalidate(projectID)
+	dbMutex.Unlock()
+
+	if err != nil {
+		logErrorf("Error deleting project %d for user %d: %v", projectID, userID, err)
+		http.Error(w, "Failed to delete project", dbErrorStatus(err))
+		return
+	}
+
+	log.Printf("Deleted project %d ('%s') for user %d", projectID, projectName, userID)
+	go notifyWebhooks(userID, webhookEventProjectDeleted, projectID, projectName)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Project deleted successfully"})
+}
+
+// POST /api/projects/{id}/archive (Authenticated)
+func archiveProjectHandler(w http.ResponseWriter, r *http.Request) {
+	setProjectArchived(w, r, true)
+}
+
+// POST /api/projects/{id}/unarchive (Authenticated)
+func unarchiveProjectHandler(w http.ResponseWriter, r *http.Request) {
+	setProjectArchived(w, r, false)
+}
+
+// setProjectArchived hides or restores a project in the default project list
+func setProjectArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if !requireProjectOwner(w, projectID, userID) {
+		return
+	}
+	defer projectCache.invalidate(projectID) // The trigger bumps updated_at
+	_, err := db.ExecContext(r.Context(), "UPDATE projects SET archived = ? WHERE id = ? AND user_id = ?", archived, projectID, userID)
+	if err != nil {
+		logErrorf("Error setting archived=%t on project %d for user %d: %v", archived, projectID, userID, err)
+		http.Error(w, "Failed to update project", dbErrorStatus(err))
+		return
+	}
+
+	log.Printf("Set archived=%t on project %d for user %d", archived, projectID, userID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"projectId": projectID, "archived": archived})
+}
+
+// POST /api/projects/{id}/touch (Authenticated)
+// Marks a project as recently used, moving it up the list without changing its content
+func touchProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	// Scoped to the owner, so another user's project looks the same as a missing one
+	defer projectCache.invalidate(projectID)
+	var updatedAt time.Time
+	result, err := db.ExecContext(r.Context(), "UPDATE projects SET updated_at = ? WHERE id = ? AND user_id = ?", time.Now(), projectID, userID)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		err = db.QueryRow("SELECT updated_at FROM projects WHERE id = ?", projectID).Scan(&updatedAt)
+	}
+	if err != nil {
+		logErrorf("Error touching project %d for user %d: %v", projectID, userID, err)
+		http.Error(w, "Failed to update project", dbErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"projectId": projectID, "updated_at": updatedAt})
+}
+
+// GET, HEAD /api/projects/{id}/image/{image_name} (Authenticated)
+func getProjectImageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	vars := mux.Vars(r)
+	projectIDStr := vars["id"]
+	imageName := vars["image_name"]
+
+	projectID, err := strconv.ParseInt(projectIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	logDebugf("Fetching image '%s' for project %d, user %d", imageName, projectID, userID)
+
+	var blob []byte
+	var ownerUserID int64
+
+	dbMutex.Lock()
+	// Verify the project belongs to the user before fetching the blob
+	err = db.QueryRow("SELECT user_id FROM projects WHERE id = ?", projectID).Scan(&ownerUserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error checking project owner for image request (project %d, user %d): %v", projectID, userID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		dbMutex.Unlock()
+		return
+	}
+
+	if ownerUserID != userID {
+		logWarnf("User %d attempted to access image '%s' from project %d owned by user %d", userID, imageName, projectID, ownerUserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		dbMutex.Unlock()
+		return
+	}
+
+	// Fetch the image blob (HEAD only needs its size and hash)
+	var size int64
+	var hash string
+	var storageKey, externalURL sql.NullString
+	var createdAt time.Time
+	err = db.QueryRow(
+		"SELECT size, COALESCE(content_hash, ''), storage_key, url, created_at FROM images WHERE project_id = ? AND name = ?",
+		projectID, imageName,
+	).Scan(&size, &hash, &storageKey, &externalURL, &createdAt)
+	if err == nil && storageKey.Valid && r.Method != http.MethodHead {
+		blob, err = loadImage(storageKey.String)
+	}
+	dbMutex.Unlock() // Unlock before writing response
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("Image '%s' not found for project %d", imageName, projectID)
+			http.Error(w, "Image not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error fetching image blob '%s' for project %d: %v", imageName, projectID, err)
+			http.Error(w, "Failed to retrieve image", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if externalURL.Valid {
+		recordAudit(r, userID, auditActionImageRead, projectID)
+		http.Redirect(w, r, externalURL.String, http.StatusFound)
+		return
+	}
+	setImageHeaders(w, imageName, hash)
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	recordAudit(r, userID, auditActionImageRead, projectID)
+	// ServeContent answers Range and conditional requests and sets Content-Length for what it sends
+	http.ServeContent(w, r, imageName, createdAt, bytes.NewReader(blob))
+}
+
+type RenameImageRequest struct {
+	NewName string `json:"new_name"`
+}
+
+// PATCH /api/projects/{id}/image/{image_name} (Authenticated)
+// Renames an image without re-uploading it
+func renameProjectImageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	imageName := mux.Vars(r)["image_name"]
+
+	var req RenameImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validateImageName(req.NewName); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid image name %q: %v", req.NewName, err), http.StatusBadRequest)
+		return
+	}
+	if imageContentType(req.NewName) != imageContentType(imageName) {
+		http.Error(w, "Renaming must keep the image's file type", http.StatusBadRequest)
+		return
+	}
+
+	unlockProject := lockProject(projectID)
+	defer unlockProject()
+
+	dbMutex.Lock()
+	if !requireProjectOwner(w, projectID, userID) {
+		dbMutex.Unlock()
+		return
+	}
+	var projectName, collision string
+	var result sql.Result
+	err := db.QueryRow("SELECT name FROM projects WHERE id = ?", projectID).Scan(&projectName)
+	if err == nil {
+		// The image itself is skipped, so a case-only rename is allowed
+		collision, err = findCaseCollision(db, req.NewName, "SELECT name FROM images WHERE project_id = ? AND name != ?", projectID, imageName)
+	}
+	if err == nil && collision == "" {
+		result, err = db.ExecContext(r.Context(), "UPDATE images SET name = ? WHERE project_id = ? AND name = ?", req.NewName, projectID, imageName)
+	}
+	projectCache.invalidate(projectID)
+	dbMutex.Unlock()
+
+	if isUniqueConstraintError(err) {
+		http.Error(w, fmt.Sprintf("Image %q already exists", req.NewName), http.StatusConflict)
+		return
+	}
+	if err == nil && collision != "" {
+		http.Error(w, fmt.Sprintf("Image name differs from existing image %q only in case", collision), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logErrorf("Error renaming image '%s' in project %d: %v", imageName, projectID, err)
+		http.Error(w, "Failed to rename image", dbErrorStatus(err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Renamed image '%s' to '%s' in project %d", imageName, req.NewName, projectID)
+	go notifyWebhooks(userID, webhookEventProjectUpdated, projectID, projectName)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Image renamed successfully", "name": req.NewName})
+}
+
+// POST /api/projects/{id}/image/{image_name}/copy-from/{src_id}?on_conflict=replace|rename|fail (Authenticated)
+// Copies an image from another of the user's projects. Image bytes are stored by content hash, so
+// the copy only adds a row referencing the stored blob. An existing image of the same name is
+// replaced by default; on_conflict=rename picks a free "name (n).ext" instead.
+func copyProjectImageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	srcID, err := strconv.ParseInt(mux.Vars(r)["src_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid source project ID", http.StatusBadRequest)
+		return
+	}
+	imageName := mux.Vars(r)["image_name"]
+
+	onConflict := r.URL.Query().Get("on_conflict")
+	if onConflict == "" {
+		onConflict = "replace"
+	}
+	if onConflict != "replace" && onConflict != "rename" && onConflict != "fail" {
+		http.Error(w, "on_conflict must be 'replace', 'rename' or 'fail'", http.StatusBadRequest)
+		return
+	}
+
+	unlockProject := lockProject(projectID)
+	defer unlockProject()
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if !requireProjectOwner(w, srcID, userID) || !requireProjectOwner(w, projectID, userID) {
+		return
+	}
+
+	var storageKey, hash, externalURL sql.NullString
+	var size int64
+	err = db.QueryRow(
+		"SELECT storage_key, content_hash, url, size FROM images WHERE project_id = ? AND name = ?", srcID, imageName,
+	).Scan(&storageKey, &hash, &externalURL, &size)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Image not found in source project", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logErrorf("Error reading image '%s' of project %d for copy: %v", imageName, srcID, err)
+		http.Error(w, "Failed to copy image", http.StatusInternalServerError)
+		return
+	}
+
+	name := imageName
+	var count int
+	var exists bool
+	err = db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(name = ?), 0) > 0 FROM images WHERE project_id = ?", name, projectID,
+	).Scan(&count, &exists)
+	if err == nil && exists && onConflict == "rename" {
+		name, err = uniqueImageName(projectID, imageName)
+		exists = false
+	}
+	var collision string
+	if err == nil {
+		collision, err = findCaseCollision(db, name, "SELECT name FROM images WHERE project_id = ?", projectID)
+	}
+	var replacedKey sql.NullString // Storage key of the image being replaced, released after the write
+	var replacedSize int64
+	if err == nil && exists {
+		err = db.QueryRow("SELECT storage_key, size FROM images WHERE project_id = ? AND name = ?", projectID, name).Scan(&replacedKey, &replacedSize)
+	}
+	if err != nil {
+		logErrorf("Error checking destination of image copy into project %d: %v", projectID, err)
+		http.Error(w, "Failed to copy image", http.StatusInternalServerError)
+		return
+	}
+	if exists && onConflict == "fail" {
+		http.Error(w, fmt.Sprintf("Image %q already exists", name), http.StatusConflict)
+		return
+	}
+	if name != imageName {
+		// The suffix can push a valid name past the length limit or the configured pattern
+		if err := validateImageName(name); err != nil {
+			http.Error(w, fmt.Sprintf("Cannot rename the copy to %q: %v", name, err), http.StatusConflict)
+			return
+		}
+	}
+	if collision != "" {
+		http.Error(w, fmt.Sprintf("Image name differs from existing image %q only in case", collision), http.StatusConflict)
+		return
+	}
+	if !exists && !checkImageCount(w, count+1) {
+		return
+	}
+	if !checkUserQuota(w, userID, size-replacedSize) {
+		return
+	}
+
+	var projectName string
+	_, err = db.ExecContext(r.Context(),
+		"INSERT OR REPLACE INTO images (project_id, name, blob, content_hash, storage_key, url, size) VALUES (?, ?, X'', ?, ?, ?, ?)",
+		projectID, name, hash, storageKey, externalURL, size,
+	)
+	if err == nil {
+		if replacedKey.Valid {
+			releaseImageKeys([]string{replacedKey.String})
+		}
+		err = db.QueryRow("SELECT name FROM projects WHERE id = ?", projectID).Scan(&projectName)
+	}
+	projectCache.invalidate(projectID)
+	if err != nil {
+		logErrorf("Error copying image '%s' from project %d to %d: %v", imageName, srcID, projectID, err)
+		http.Error(w, "Failed to copy image", dbErrorStatus(err))
+		return
+	}
+
+	log.Printf("Copied image '%s' from project %d to project %d as '%s'", imageName, srcID, projectID, name)
+	go notifyWebhooks(userID, webhookEventProjectUpdated, projectID, projectName)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Image copied successfully", "name": name})
+}
+
+// uniqueImageName returns a name derived from name ("logo (2).png", "logo (3).png", ...) that no
+// image of the project uses yet. The caller must hold dbMutex.
+func uniqueImageName(projectID int64, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE project_id = ? AND name = ?)", projectID, candidate).Scan(&exists)
+		if err != nil || !exists {
+			return candidate, err
+		}
+	}
+}
+
+// imageContentType determines the content type of an image (simple check based on extension)
+func imageContentType(imageName string) string {
+	contentType := "application/octet-stream" // Default
+	ext := filepath.Ext(imageName)
+	switch ext {
+	case ".png":
+		contentType = "image/png"
+	case ".jpg", ".jpeg":
+		contentType = "image/jpeg"
+	case ".gif":
+		contentType = "image/gif"
+	case ".svg":
+		contentType = "image/svg+xml"
+	case ".webp":
+		contentType = "image/webp"
+	}
+	return contentType
+}
+
+// checkImageContent rejects image data that is not one of the supported formats or does not
+// match the name's extension, so the read path can trust the type derived from the name
+func checkImageContent(name string, blob []byte) error {
+	expected := imageContentType(name)
+	if expected == "application/octet-stream" {
+		return fmt.Errorf("unsupported extension %q, expected .png, .jpg, .jpeg, .gif, .svg or .webp", filepath.Ext(name))
+	}
+	detected, _, _ := strings.Cut(http.DetectContentType(blob), ";")
+	if expected == "image/svg+xml" {
+		// SVG is sniffed as XML or plain text; require the root element to appear near the start
+		head := bytes.ToLower(blob[:min(len(blob), 1024)])
+		if (detected == "text/xml" || detected == "text/plain") && bytes.Contains(head, []byte("<svg")) {
+			return nil
+		}
+		return fmt.Errorf("content is %s, not SVG", detected)
+	}
+	if detected != expected {
+		return fmt.Errorf("content is %s, but the extension implies %s", detected, expected)
+	}
+	return nil
+}
+
+// setImageHeaders sets the headers shared by GET and HEAD image responses. Uploaded SVGs may
+// carry scripts, so images are served with a policy that runs nothing and are never sniffed as HTML.
+func setImageHeaders(w http.ResponseWriter, imageName string, hash string) {
+	w.Header().Set("Content-Type", imageContentType(imageName))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if hash != "" {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+}
+
+// GET /api/projects/{id}/images.zip (Authenticated)
+// Streams every image of the project as a zip archive, one blob in memory at a time
+func getProjectImagesZipHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	if !requireProjectOwner(w, projectID, userID) {
+		dbMutex.Unlock()
+		return
+	}
+	imageNames, err := projectImageNames(projectID)
+	dbMutex.Unlock()
+	if err != nil {
+		logErrorf("Error fetching image names for project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve project images", http.StatusInternalServerError)
+		return
+	}
+	streamImagesZip(w, projectID, imageNames)
+}
+
+// POST /api/projects/{id}/images/download (Authenticated)
+// Streams the images listed in {"names": [...]}, or all of them when names is omitted, as a zip.
+// Unknown names are answered with 404 before anything is streamed.
+func downloadProjectImagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req DownloadImagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF { // An empty body downloads everything
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	dbMutex.Lock()
+	if !requireProjectOwner(w, projectID, userID) {
+		dbMutex.Unlock()
+		return
+	}
+	imageNames, err := projectImageNames(projectID)
+	dbMutex.Unlock()
+	if err != nil {
+		logErrorf("Error fetching image names for project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve project images", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Names != nil {
+		var missing []string
+		for _, name := range req.Names {
+			if !slices.Contains(imageNames, name) {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			http.Error(w, fmt.Sprintf("Images not found: %s", strings.Join(missing, ", ")), http.StatusNotFound)
+			return
+		}
+		imageNames = slices.Compact(slices.Sorted(slices.Values(req.Names)))
+	}
+	streamImagesZip(w, projectID, imageNames)
+}
+
+// streamImagesZip writes the named images of a project as a zip archive, one blob in memory at a time
+func streamImagesZip(w http.ResponseWriter, projectID int64, imageNames []string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"project-%d-images.zip\"", projectID))
+	w.WriteHeader(http.StatusOK)
+
+	// Headers are sent, so errors from here on can only be logged and the archive truncated
+	zw := zip.NewWriter(w)
+	for _, name := range imageNames {
+		dbMutex.Lock()
+		blob, err := readProjectImage(projectID, name)
+		dbMutex.Unlock()
+		if err == sql.ErrNoRows || err == errExternalImage {
+			continue // Deleted while streaming, or nothing stored to include
+		}
+		if err != nil {
+			logErrorf("Error fetching image '%s' for project %d zip: %v", name, projectID, err)
+			return
+		}
+
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+		if err != nil {
+			logErrorf("Error adding '%s' to zip for project %d: %v", name, projectID, err)
+			return
+		}
+		if _, err := entry.Write(blob); err != nil {
+			logErrorf("Error writing '%s' to zip for project %d: %v", name, projectID, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logErrorf("Error finishing zip for project %d: %v", projectID, err)
+		return
+	}
+	log.Printf("Streamed %d images for project %d as zip", len(imageNames), projectID)
+}
+
+// projectImageNames returns the image names of a project in name order. The caller must hold dbMutex.
+func projectImageNames(projectID int64) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM images WHERE project_id = ? ORDER BY name", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// imageSortColumns maps ?sort= values of the image listing to ORDER BY clauses
+var imageSortColumns = map[string]string{
+	"name":    "name",
+	"size":    "size DESC, name",
+	"created": "created_at DESC, name",
+}
+
+// GET /api/projects/{id}/images (Authenticated)
+// Pages through image metadata with ?limit=&offset=&sort=name|size|created; the total field
+// and the X-Total-Count header carry the number of images in the project
+func getProjectImagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	sortKey := r.URL.Query().Get("sort")
+	if sortKey == "" {
+		sortKey = "name"
+	}
+	orderBy, ok := imageSortColumns[sortKey]
+	if !ok {
+		http.Error(w, "Invalid sort, expected name, size or created", http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := paginationParams(w, r, 100, 1000)
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if !requireProjectOwner(w, projectID, userID) {
+		return
+	}
+
+	list := ImageList{Images: []ImageMetadata{}}
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images WHERE project_id = ?", projectID).Scan(&list.Total, &list.TotalBytes)
+	if err != nil {
+		logErrorf("Error counting images for project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve images", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT name, size, COALESCE(url, ''), created_at FROM images WHERE project_id = ? ORDER BY "+orderBy+" LIMIT ? OFFSET ?",
+		projectID, limit, offset,
+	)
+	if err != nil {
+		logErrorf("Error querying images for project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve images", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var img ImageMetadata
+		if err := rows.Scan(&img.Name, &img.Size, &img.URL, &img.CreatedAt); err != nil {
+			logErrorf("Error scanning image row for project %d: %v", projectID, err)
+			http.Error(w, "Failed to retrieve images", http.StatusInternalServerError)
+			return
+		}
+		img.ContentType = imageContentType(img.Name)
+		list.Images = append(list.Images, img)
+	}
+	if err := rows.Err(); err != nil {
+		logErrorf("Error iterating image rows for project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve images", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(list.Total))
+	json.NewEncoder(w).Encode(list)
+}
+
+// GET /api/projects/{id}/images/duplicates (Authenticated)
+// Reports groups of images in the project that share identical content
+func getDuplicateImagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if !requireProjectOwner(w, projectID, userID) {
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT content_hash, name, size FROM images WHERE project_id = ? AND content_hash IN "+
+			"(SELECT content_hash FROM images WHERE project_id = ? GROUP BY content_hash HAVING COUNT(*) > 1) "+
+			"ORDER BY content_hash, name",
+		projectID, projectID,
+	)
+	if err != nil {
+		logErrorf("Error querying duplicate images for project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve duplicate images", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	groups := []DuplicateImageGroup{}
+	for rows.Next() {
+		var hash, name string
+		var size int64
+		if err := rows.Scan(&hash, &name, &size); err != nil {
+			logErrorf("Error scanning duplicate image row for project %d: %v", projectID, err)
+			http.Error(w, "Failed to retrieve duplicate images", http.StatusInternalServerError)
+			return
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Hash != hash {
+			groups = append(groups, DuplicateImageGroup{Hash: hash, Size: size})
+		}
+		groups[len(groups)-1].Names = append(groups[len(groups)-1].Names, name)
+	}
+	if err := rows.Err(); err != nil {
+		logErrorf("Error iterating duplicate image rows for project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve duplicate images", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// MergeDuplicatesResult reports which duplicate images were folded into which kept image
+type MergeDuplicatesResult struct {
+	Merged      map[string]string `json:"merged"` // Removed name -> kept name
+	BodyUpdated bool              `json:"body_updated"`
+}
+
+// POST /api/projects/{id}/images/duplicates/merge (Authenticated)
+// Keeps one image of every set of identical images and deletes the others, pointing body
+// references at the kept one. The image used first in the body is kept, otherwise the first by name.
+func mergeDuplicateImagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	unlockProject := lockProject(projectID)
+	defer unlockProject()
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	var projectName, body string
+	err := db.QueryRow("SELECT name, body FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&projectName, (*storedBody)(&body))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			logErrorf("Error fetching project %d for duplicate merge: %v", projectID, err)
+			http.Error(w, "Failed to merge duplicate images", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	firstUse := make(map[string]int)
+	for i, name := range bodyImageReferences(body) {
+		firstUse[name] = i
+	}
+	var result MergeDuplicatesResult
+	err = withWriteTx(r.Context(), func(tx *sql.Tx) error {
+		result = MergeDuplicatesResult{Merged: map[string]string{}}
+		groups := make(map[string][]string) // Content hash -> names, in name order
+		rows, err := tx.QueryContext(r.Context(), "SELECT content_hash, name FROM images WHERE project_id = ? AND content_hash IS NOT NULL ORDER BY name", projectID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var hash, name string
+			if err := rows.Scan(&hash, &name); err != nil {
+				rows.Close()
+				return err
+			}
+			groups[hash] = append(groups[hash], name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, names := range groups {
+			if len(names) < 2 {
+				continue
+			}
+			kept := names[0]
+			for _, name := range names[1:] {
+				if i, used := firstUse[name]; used {
+					if j, keptUsed := firstUse[kept]; !keptUsed || i < j {
+						kept = name
+					}
+				}
+			}
+			for _, name := range names {
+				if name == kept {
+					continue
+				}
+				result.Merged[name] = kept
+				// Both rows share one storage key, so no image bytes are freed here
+				if _, err := tx.ExecContext(r.Context(), "DELETE FROM images WHERE project_id = ? AND name = ?", projectID, name); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(result.Merged) == 0 {
+			return nil
+		}
+		newBody := renameImageReferences(body, result.Merged)
+		if newBody == body {
+			return nil
+		}
+		result.BodyUpdated = true
+		sealed, err := sealBody(newBody)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(r.Context(), "UPDATE projects SET body = ?, updated_at = ? WHERE id = ?", sealed, time.Now(), projectID); err != nil {
+			return err
+		}
+		return recordProjectVersion(r.Context(), tx, projectID)
+	})
+	projectCache.invalidate(projectID)
+	if err != nil {
+		logErrorf("Error merging duplicate images of project %d: %v", projectID, err)
+		http.Error(w, "Failed to merge duplicate images", dbErrorStatus(err))
+		return
+	}
+
+	if len(result.Merged) > 0 {
+		log.Printf("Merged %d duplicate images in project %d for user %d", len(result.Merged), projectID, userID)
+		go notifyWebhooks(userID, webhookEventProjectUpdated, projectID, projectName)
+		recordAuditAsync(r, userID, auditActionProjectUpdate, projectID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// applyBodyPatch loads the stored body, checks it is the patch's base and returns the patched body.
+// The caller must hold the project lock.
+func applyBodyPatch(w http.ResponseWriter, projectID, userID int64, patch *BodyPatch) (string, bool) {
+	var base string
+	dbMutex.Lock()
+	err := db.QueryRow("SELECT body FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan((*storedBody)(&base))
+	dbMutex.Unlock()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found or access denied", http.StatusNotFound)
+		} else {
+			logErrorf("Error fetching body of project %d for patching: %v", projectID, err)
+			http.Error(w, "Failed to update project", http.StatusInternalServerError)
+		}
+		return "", false
+	}
+	if current := contentHash([]byte(base)); !strings.EqualFold(patch.BaseHash, current) {
+		http.Error(w, fmt.Sprintf("Body has changed since the patch base; current base_hash is %s", current), http.StatusConflict)
+		return "", false
+	}
+
+	var b strings.Builder
+	pos := 0
+	for i, op := range patch.Ops {
+		// Written so that huge offsets or deletes cannot overflow the sum
+		if op.Offset < 0 || op.Offset < pos || op.Offset > len(base) || op.Delete < 0 || op.Delete > len(base)-op.Offset {
+			http.Error(w, fmt.Sprintf("body_patch.ops[%d] is out of range or overlaps the previous op", i), http.StatusBadRequest)
+			return "", false
+		}
+		b.WriteString(base[pos:op.Offset])
+		b.WriteString(op.Insert)
+		pos = op.Offset + op.Delete
+	}
+	b.WriteString(base[pos:])
+	return b.String(), true
+}
+
+// PUT /api/projects/{id} (Authenticated) - Sync Endpoint
+// PUT /api/projects/{id}?dry_run=true reports the image changes without applying them
+// PUT /api/projects/{id}?require_images=true rejects bodies referencing images not in the request
+// PUT /api/projects/{id} with body_patch applies {offset,delete,insert} ops to the body whose SHA-256 is base_hash (409 when stale)
+func updateProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	vars := mux.Vars(r)
+	projectIDStr := vars["id"]
+	projectID, err := strconv.ParseInt(projectIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var req UpdateProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Serialize syncs of this project; released after the deferred commit/rollback below.
+	// Taken before a patch is applied so the base body cannot change underneath it.
+	unlockProject := lockProject(projectID)
+	defer unlockProject()
+
+	if req.BodyPatch != nil {
+		if req.Body != "" {
+			http.Error(w, "Send either body or body_patch, not both", http.StatusBadRequest)
+			return
+		}
+		body, ok := applyBodyPatch(w, projectID, userID, req.BodyPatch)
+		if !ok {
+			return
+		}
+		req.Body = body
+	}
+	if !checkBodySize(w, req.Body) {
+		return
+	}
+	requestedNames := make(map[string]bool)
+	var nameList []string
+	for _, img := range req.Images {
+		if img.Name != "" && !requestedNames[img.Name] {
+			requestedNames[img.Name] = true
+			nameList = append(nameList, img.Name)
+		}
+	}
+	if !checkImageCount(w, len(requestedNames)) {
+		return
+	}
+	if a, b, ok := findFoldedDuplicate(nameList); ok {
+		http.Error(w, fmt.Sprintf("Image names %q and %q differ only in case", a, b), http.StatusConflict)
+		return
+	}
+	var validation ValidationErrors
+	projectName, err := validateProjectName(req.Name)
+	validation.check("name", err)
+	validation.check("content_type", validateProjectContentType(req.ContentType))
+
+	// Every entry is checked before the transaction opens, so all problems are reported at once.
+	// Names sent without blob data refer to images already stored and only need a valid name.
+	blobs := make(map[string][]byte)
+	seenNames := make(map[string]int)
+	for i, img := range req.Images {
+		field := fmt.Sprintf("images[%d]", i)
+		if err := validateImageName(img.Name); err != nil {
+			validation.add(field+".name", fmt.Sprintf("invalid image name %q: %v", img.Name, err))
+			continue
+		}
+		if first, ok := seenNames[img.Name]; ok {
+			validation.add(field+".name", fmt.Sprintf("image %q is already listed at images[%d]", img.Name, first))
+			continue
+		}
+		seenNames[img.Name] = i
+		if img.URL != "" {
+			if img.BlobBase64 != "" {
+				validation.add(field, fmt.Sprintf("image %q must have either blob_base64 or url, not both", img.Name))
+			} else if err := validateImageURL(img.URL); err != nil {
+				validation.add(field+".url", fmt.Sprintf("invalid url for image %q: %v", img.Name, err))
+			}
+			continue
+		}
+		if img.BlobBase64 == "" {
+			continue
+		}
+		if cfg.MaxImageBytes > 0 && base64.StdEncoding.DecodedLen(len(img.BlobBase64)) > cfg.MaxImageBytes+2 { // DecodedLen rounds up to whole groups
+			validation.add(field+".blob_base64", fmt.Sprintf("image %q exceeds the limit of %d bytes", img.Name, cfg.MaxImageBytes))
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(img.BlobBase64)
+		if err != nil {
+			logErrorf("Error decoding base64 for image '%s' in project %d: %v", img.Name, projectID, err)
+			validation.add(field+".blob_base64", "invalid base64 image data for "+img.Name)
+			continue
+		}
+		if cfg.MaxImageBytes > 0 && len(blob) > cfg.MaxImageBytes {
+			validation.add(field+".blob_base64", fmt.Sprintf("image %q exceeds the limit of %d bytes", img.Name, cfg.MaxImageBytes))
+			continue
+		}
+		if err := checkImageContent(img.Name, blob); err != nil {
+			validation.add(field+".blob_base64", fmt.Sprintf("image %q: %v", img.Name, err))
+			continue
+		}
+		blobs[img.Name] = blob
+	}
+	if requireImages, _ := strconv.ParseBool(r.URL.Query().Get("require_images")); requireImages {
+		for _, name := range bodyImageReferences(req.Body) {
+			if !requestedNames[name] {
+				validation.add("body", fmt.Sprintf("references image %q, which is not in images", name))
+			}
+		}
+	}
+	if validation.respond(w) {
+		return
+	}
+
+	if projectName == "" {
+		projectName = defaultProjectName // Or handle error
+	}
+
+	// Dry run: run the full sync inside the transaction, then roll back and report what would change
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	var summary SyncSummary
+
+	if dryRun {
+		log.Printf("Dry-run update of project %d ('%s') for user %d", projectID, req.Name, userID)
+	} else {
+		log.Printf("Updating project %d ('%s') for user %d", projectID, req.Name, userID)
+	}
+
+	dbMutex.Lock() // Lock for the duration of the transaction
+	defer dbMutex.Unlock()
+
+	// Charge the quota for the difference between the synced project and the stored one
+	bodyBytes, imageSizes, err := projectStorageBytes(projectID, userID)
+	if err != nil && err != sql.ErrNoRows { // A missing project is answered by the sync below
+		logErrorf("Error computing storage of project %d: %v", projectID, err)
+		http.Error(w, "Failed to save changes", dbErrorStatus(err))
+		return
+	}
+	delta := int64(len(req.Body)) - bodyBytes
+	for _, size := range imageSizes {
+		delta -= size
+	}
+	for _, img := range req.Images {
+		if blob, ok := blobs[img.Name]; ok {
+			delta += int64(len(blob))
+		} else if img.URL == "" {
+			delta += imageSizes[img.Name] // Kept as stored
+		}
+	}
+	if !checkUserQuota(w, userID, delta) {
+		return
+	}
+
+	// New image bytes go to the image store before the transaction, which then only records keys.
+	// Keys left unreferenced by a failed sync, or by images it deleted or replaced, are released.
+	var storedKeys, existingKeys []string
+	defer func() {
+		if p := recover(); p != nil {
+			releaseImageKeys(storedKeys)
+			panic(p) // Re-throw panic
+		}
+	}()
+	if !dryRun {
+		for name, blob := range blobs {
+			key, err := storeImage(blob)
+			if err != nil {
+				releaseImageKeys(storedKeys)
+				logErrorf("Error storing image '%s' for project %d: %v", name, projectID, err)
+				http.Error(w, "Failed to store image "+name, http.StatusInternalServerError)
+				return
+			}
+			storedKeys = append(storedKeys, key)
+		}
+	}
+
+	// A dry run rolls back instead of committing
+	err = func() error {
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() // No-op after a successful commit; never applies a dry run
+		if summary, existingKeys, err = syncProjectTx(r.Context(), tx, &req, projectID, userID, projectName, blobs, dryRun); err != nil {
+			return err
+		}
+		if dryRun {
+			return nil
+		}
+		return tx.Commit()
+	}()
+	if !dryRun {
+		projectCache.invalidate(projectID)
+	}
+	if err != nil {
+		releaseImageKeys(storedKeys)
+		var collision *nameCollisionError
+		switch {
+		case errors.As(err, &collision):
+			http.Error(w, fmt.Sprintf("Project name differs from existing project %q only in case", collision.existing), http.StatusConflict)
+		case errors.Is(err, sql.ErrNoRows):
+			log.Printf("Project %d not found or does not belong to user %d during update", projectID, userID)
+			http.Error(w, "Project not found or access denied", http.StatusNotFound)
+		default:
+			logErrorf("Error updating project %d: %v", projectID, err)
+			http.Error(w, "Failed to save changes", dbErrorStatus(err))
+		}
+		return
+	}
+
+	if dryRun {
+		sort.Strings(summary.Added)
+		sort.Strings(summary.Deleted)
+		sort.Strings(summary.Updated)
+		log.Printf("Dry run for project %d: %d added, %d deleted, %d updated, name changed %t, body changed %t",
+			projectID, len(summary.Added), len(summary.Deleted), len(summary.Updated), summary.NameChanged, summary.BodyChanged)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+		return
+	}
+
+	releaseImageKeys(append(existingKeys, storedKeys...))
+	log.Printf("Successfully updated project %d", projectID)
+	go notifyWebhooks(userID, webhookEventProjectUpdated, projectID, projectName)
+	recordAuditAsync(r, userID, auditActionProjectUpdate, projectID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Project updated successfully"})
+}
+
+// nameCollisionError reports a project name that differs from an existing one only in case
+type nameCollisionError struct {
+	existing string
+}
+
+func (e *nameCollisionError) Error() string {
+	return fmt.Sprintf("project name collides with %q", e.existing)
+}
+
+// syncProjectTx applies a sync inside tx: project details, then images, then a version snapshot.
+// It returns the changes it made and the storage keys the project referenced before. A missing
+// project returns sql.ErrNoRows and a case-only name clash a *nameCollisionError.
+func syncProjectTx(ctx context.Context, tx *sql.Tx, req *UpdateProjectRequest, projectID, userID int64, projectName string,
+	blobs map[string][]byte, dryRun bool) (SyncSummary, []string, error) {
+	summary := SyncSummary{Added: []string{}, Deleted: []string{}, Updated: []string{}}
+	var existingKeys []string
+
+	// 1. Verify project ownership and update project details
+
+	collision, err := findCaseCollision(tx, projectName, "SELECT name FROM projects WHERE user_id = ? AND id != ?", userID, projectID)
+	if err != nil {
+		return summary, nil, fmt.Errorf("checking name collisions: %w", err)
+	}
+	if collision != "" {
+		return summary, nil, &nameCollisionError{collision}
+	}
+
+	if dryRun {
+		var oldName, oldBody string
+		err = tx.QueryRowContext(ctx, "SELECT name, body FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&oldName, (*storedBody)(&oldBody))
+		if err != nil && err != sql.ErrNoRows { // A missing project is answered by the UPDATE below
+			return summary, nil, fmt.Errorf("reading current project: %w", err)
+		}
+		summary.NameChanged, summary.BodyChanged = err == nil && oldName != projectName, err == nil && oldBody != req.Body
+	}
+
+	sealed, err := sealBody(req.Body)
+	if err != nil {
+		return summary, nil, fmt.Errorf("encrypting body: %w", err)
+	}
+	result, err := tx.ExecContext(ctx,
+		"UPDATE projects SET name = ?, content_type = COALESCE(NULLIF(?, ''), content_type), body = ?, updated_at = ? WHERE id = ? AND user_id = ?",
+		projectName, req.ContentType, sealed, time.Now(), projectID, userID,
+	)
+	if err != nil {
+		return summary, nil, fmt.Errorf("updating project details: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return summary, nil, sql.ErrNoRows
+	}
+
+	// 2. Synchronize images: Delete removed images, Add/Update others
+	existingImages := make(map[string]bool)
+	var existingNames []string // In name order, so images are processed (and logged) deterministically
+	rows, err := tx.QueryContext(ctx, "SELECT name, storage_key FROM images WHERE project_id = ? ORDER BY name", projectID)
+	if err != nil {
+		return summary, nil, fmt.Errorf("querying existing images: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		var key sql.NullString // NULL for external images
+		if err = rows.Scan(&name, &key); err != nil {
+			rows.Close()
+			return summary, nil, fmt.Errorf("scanning existing image name: %w", err)
+		}
+		existingImages[name] = true
+		existingNames = append(existingNames, name)
+		if key.Valid {
+			existingKeys = append(existingKeys, key.String)
+		}
+	}
+	rows.Close() // Close rows before next query/exec
+
+	requestedImages := make(map[string]ProjectUpdateImage)
+	for _, img := range req.Images {
+		if img.Name != "" {
+			requestedImages[img.Name] = img
+		}
+	}
+
+	// Delete images that exist in DB but not in the request
+	for _, name := range existingNames {
+		if _, exists := requestedImages[name]; !exists {
+			logDebugf("Deleting image '%s' from project %d", name, projectID)
+			summary.Deleted = append(summary.Deleted, name)
+			if _, err = tx.ExecContext(ctx, "DELETE FROM images WHERE project_id = ? AND name = ?", projectID, name); err != nil {
+				return summary, nil, fmt.Errorf("deleting image '%s': %w", name, err)
+			}
+		}
+	}
+
+	// Add or Update images present in the request, in request order
+	for _, imgData := range req.Images {
+		name := imgData.Name
+		if name == "" {
+			continue
+		}
+		if imgData.BlobBase64 != "" { // Only process if blob data is provided
+			blob := blobs[name]
+			key := contentHash(blob)
+
+			if existingImages[name] {
+				// Use INSERT OR REPLACE (Upsert)
+				logDebugf("Updating image '%s' in project %d", name, projectID)
+				summary.Updated = append(summary.Updated, name)
+				_, err = tx.ExecContext(ctx,
+					"INSERT OR REPLACE INTO images (project_id, name, blob, content_hash, storage_key, size) VALUES (?, ?, X'', ?, ?, ?)",
+					projectID, name, key, key, len(blob),
+				)
+			} else {
+				// Insert new image
+				logDebugf("Inserting new image '%s' into project %d", name, projectID)
+				summary.Added = append(summary.Added, name)
+				_, err = tx.ExecContext(ctx,
+					"INSERT INTO images (project_id, name, blob, content_hash, storage_key, size) VALUES (?, ?, X'', ?, ?, ?)",
+					projectID, name, key, key, len(blob),
+				)
+			}
+			if err != nil {
+				return summary, nil, fmt.Errorf("upserting image '%s': %w", name, err)
+			}
+		} else if imgData.URL != "" {
+			// External image: only the URL is recorded; the blob and size stay empty
+			if existingImages[name] {
+				logDebugf("Pointing image '%s' in project %d at %s", name, projectID, imgData.URL)
+				summary.Updated = append(summary.Updated, name)
+			} else {
+				logDebugf("Inserting external image '%s' into project %d", name, projectID)
+				summary.Added = append(summary.Added, name)
+			}
+			_, err = tx.ExecContext(ctx,
+				"INSERT OR REPLACE INTO images (project_id, name, blob, url, size) VALUES (?, ?, X'', ?, 0)",
+				projectID, name, imgData.URL,
+			)
+			if err != nil {
+				return summary, nil, fmt.Errorf("upserting external image '%s': %w", name, err)
+			}
+		} else if !existingImages[name] {
+			// Image requested without blob data, and it doesn't exist yet. This is likely an error
+			// or indicates the client expects the server to keep the old blob if name matches.
+			// For simplicity, we'll treat this as an error or ignore it. Ignoring for now.
+			logDebugf("Image '%s' requested for project %d without blob data and doesn't exist, skipping insert.", name, projectID)
+		}
+	}
+
+	// 3. Snapshot the synced state into the version history
+	if err = recordProjectVersion(ctx, tx, projectID); err != nil {
+		return summary, nil, fmt.Errorf("recording version: %w", err)
+	}
+	return summary, existingKeys, nil
+}
+
+// AccountStats summarizes the authenticated user's stored data
+type AccountStats struct {
+	ProjectCount    int64      `json:"project_count"`
+	ImageCount      int64      `json:"image_count"`
+	TotalImageBytes int64      `json:"total_image_bytes"`
+	OldestProjectAt *time.Time `json:"oldest_project_at"`
+	NewestUpdateAt  *time.Time `json:"newest_update_at"`
+}
+
+// GET /api/account/stats (Authenticated)
+func getAccountStatsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+
+	var stats AccountStats
+	var oldest, newest sql.NullTime
+
+	dbMutex.Lock()
+	err := db.QueryRow("SELECT COUNT(*) FROM projects WHERE user_id = ?", userID).Scan(&stats.ProjectCount)
+	if err == nil {
+		err = db.QueryRow(
+			"SELECT COUNT(i.id), COALESCE(SUM(i.size), 0) FROM images i JOIN projects p ON p.id = i.project_id WHERE p.user_id = ?",
+			userID,
+		).Scan(&stats.ImageCount, &stats.TotalImageBytes)
+	}
+	// Selecting the columns directly (rather than MIN/MAX) keeps their TIMESTAMP type for scanning
+	if err == nil && stats.ProjectCount > 0 {
+		err = db.QueryRow("SELECT created_at FROM projects WHERE user_id = ? ORDER BY created_at ASC LIMIT 1", userID).Scan(&oldest)
+	}
+	if err == nil && stats.ProjectCount > 0 {
+		err = db.QueryRow("SELECT updated_at FROM projects WHERE user_id = ? ORDER BY updated_at DESC LIMIT 1", userID).Scan(&newest)
+	}
+	dbMutex.Unlock()
+
+	if err != nil {
+		logErrorf("Error computing account stats for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve account stats", http.StatusInternalServerError)
+		return
+	}
+	if oldest.Valid {
+		stats.OldestProjectAt = &oldest.Time
+	}
+	if newest.Valid {
+		stats.NewestUpdateAt = &newest.Time
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// --- Contact Sheet ---
+
+const (
+	contactSheetLabelHeight = 18       // Pixels below each thumbnail for the image name
+	contactSheetMaxPixels   = 40 << 20 // Largest sheet rendered, in pixels
+	contactSheetMaxSource   = 50 << 20 // Largest source image decoded, in pixels
+)
+
+var (
+	contactSheetBackground  = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	contactSheetPlaceholder = color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+	contactSheetText        = color.RGBA{0x33, 0x33, 0x33, 0xff}
+)
+
+// GET /api/projects/{id}/contact-sheet?columns=4&size=160 (Authenticated)
+// Renders all images of a project as a labelled grid of thumbnails in one PNG. Images that cannot
+// be decoded (SVG, unknown formats) are shown as grey placeholders.
+func getContactSheetHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	columns, ok := intQueryParam(w, r, "columns", 4, 1, 20)
+	if !ok {
+		return
+	}
+	size, ok := intQueryParam(w, r, "size", 160, 32, 512)
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	if !requireProjectOwner(w, projectID, userID) {
+		dbMutex.Unlock()
+		return
+	}
+	imageNames, err := projectImageNames(projectID)
+	dbMutex.Unlock()
+	if err != nil {
+		logErrorf("Error fetching image names for project %d: %v", projectID, err)
+		http.Error(w, "Failed to retrieve project images", http.StatusInternalServerError)
+		return
+	}
+	if len(imageNames) == 0 {
+		http.Error(w, "Project has no images", http.StatusNotFound)
+		return
+	}
+
+	columns = min(columns, len(imageNames))
+	rows := (len(imageNames) + columns - 1) / columns
+	cellHeight := size + contactSheetLabelHeight
+	if columns*size*rows*cellHeight > contactSheetMaxPixels {
+		http.Error(w, "Contact sheet would be too large, use a smaller size", http.StatusBadRequest)
+		return
+	}
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*size, rows*cellHeight))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(contactSheetBackground), image.Point{}, draw.Src)
+	for i, name := range imageNames {
+		if err := r.Context().Err(); err != nil {
+			http.Error(w, "Request timed out, please try again", dbErrorStatus(err))
+			return
+		}
+		cell := image.Rect(0, 0, size, size).Add(image.Pt(i%columns*size, i/columns*cellHeight))
+
+		dbMutex.Lock()
+		blob, err := readProjectImage(projectID, name)
+		dbMutex.Unlock()
+		if err != nil && err != sql.ErrNoRows && err != errExternalImage { // Both get a placeholder
+			logErrorf("Error fetching image '%s' for project %d contact sheet: %v", name, projectID, err)
+			http.Error(w, "Failed to retrieve project images", http.StatusInternalServerError)
+			return
+		}
+		if thumb := decodeThumbnailSource(blob); thumb != nil {
+			drawThumbnail(sheet, cell, thumb)
+		} else {
+			draw.Draw(sheet, cell.Inset(size/8), image.NewUniform(contactSheetPlaceholder), image.Point{}, draw.Src)
+		}
+		drawLabel(sheet, image.Rect(cell.Min.X, cell.Max.Y, cell.Max.X, cell.Max.Y+contactSheetLabelHeight), name)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, sheet); err != nil {
+		logErrorf("Error encoding contact sheet for project %d: %v", projectID, err)
+		http.Error(w, "Failed to render contact sheet", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// intQueryParam parses an optional integer query parameter within [min, max], responding with 400 otherwise
+func intQueryParam(w http.ResponseWriter, r *http.Request, name string, def, min, max int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		http.Error(w, fmt.Sprintf("%s must be a number from %d to %d", name, min, max), http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
+
+// decodeThumbnailSource decodes a raster image, returning nil for unsupported formats and for
+// images too large to decode safely
+func decodeThumbnailSource(blob []byte) image.Image {
+	config, _, err := image.DecodeConfig(bytes.NewReader(blob))
+	if err != nil || config.Width*config.Height > contactSheetMaxSource {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(blob))
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+// drawThumbnail scales src to fit inside cell, keeping its aspect ratio, and centers it
+func drawThumbnail(dst *image.RGBA, cell image.Rectangle, src image.Image) {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw == 0 || sh == 0 {
+		return
+	}
+	tw, th := cell.Dx(), cell.Dy()
+	if sw*th > sh*tw {
+		th = max(1, sh*tw/sw)
+	} else {
+		tw = max(1, sw*th/sh)
+	}
+	offset := image.Pt((cell.Dx()-tw)/2, (cell.Dy()-th)/2)
+	target := image.Rect(0, 0, tw, th).Add(cell.Min).Add(offset)
+	xdraw.ApproxBiLinear.Scale(dst, target, src, src.Bounds(), draw.Over, nil)
+}
+
+// drawLabel writes text centered in area, cutting it short with "..." when it does not fit
+func drawLabel(dst *image.RGBA, area image.Rectangle, text string) {
+	face := basicfont.Face7x13
+	drawer := &font.Drawer{Dst: dst, Src: image.NewUniform(contactSheetText), Face: face}
+	maxWidth := fixed.I(area.Dx() - 4)
+	if drawer.MeasureString(text) > maxWidth {
+		runes := []rune(text)
+		for len(runes) > 0 && drawer.MeasureString(string(runes)+"...") > maxWidth {
+			runes = runes[:len(runes)-1]
+		}
+		text = string(runes) + "..."
+	}
+	width := drawer.MeasureString(text)
+	drawer.Dot = fixed.Point26_6{
+		X: fixed.I(area.Min.X) + (fixed.I(area.Dx())-width)/2,
+		Y: fixed.I(area.Min.Y + face.Ascent + (area.Dy()-face.Height)/2),
+	}
+	drawer.DrawString(text)
+}
+
+// --- Image Conversion ---
+
+// svgRasterizer renders SVG images to PNG for conversion; without it SVG conversions answer 501
+const svgRasterizer = "rsvg-convert"
+
+// convertContentTypes maps the ?to= formats of image conversion to their content types
+var convertContentTypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"gif":  "image/gif",
+}
+
+// GET /api/projects/{id}/image/{image_name}/convert?to=png|jpeg|gif&quality=90 (Authenticated)
+// Re-encodes a stored image into another format for export without changing the stored image.
+// ?quality= (1-100) applies to JPEG output. SVG sources need rsvg-convert installed.
+func convertProjectImageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	imageName := mux.Vars(r)["image_name"]
+	format := strings.ToLower(r.URL.Query().Get("to"))
+	contentType, ok := convertContentTypes[format]
+	if !ok {
+		http.Error(w, "Invalid to, expected png, jpeg or gif", http.StatusBadRequest)
+		return
+	}
+	quality, ok := intQueryParam(w, r, "quality", jpeg.DefaultQuality, 1, 100)
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	if !requireProjectOwner(w, projectID, userID) {
+		dbMutex.Unlock()
+		return
+	}
+	blob, err := readProjectImage(projectID, imageName)
+	dbMutex.Unlock()
+	if err == sql.ErrNoRows {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err == errExternalImage {
+		http.Error(w, "Externally hosted images cannot be converted", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logErrorf("Error fetching image '%s' for project %d: %v", imageName, projectID, err)
+		http.Error(w, "Failed to retrieve image", http.StatusInternalServerError)
+		return
+	}
+
+	if imageContentType(imageName) == "image/svg+xml" {
+		if _, err := exec.LookPath(svgRasterizer); err != nil {
+			http.Error(w, "Converting SVG images is not available on this server", http.StatusNotImplemented)
+			return
+		}
+		if blob, err = rasterizeSVG(r.Context(), blob); err != nil {
+			logErrorf("Error rasterizing SVG image '%s' for project %d: %v", imageName, projectID, err)
+			http.Error(w, "Failed to rasterize SVG image", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(blob))
+	if err != nil {
+		http.Error(w, "Image format cannot be converted", http.StatusUnsupportedMediaType)
+		return
+	}
+	if config.Width*config.Height > contactSheetMaxSource {
+		http.Error(w, "Image is too large to convert", http.StatusRequestEntityTooLarge)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(blob))
+	if err != nil {
+		http.Error(w, "Image data is corrupt: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg", "jpg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		logErrorf("Error encoding image '%s' of project %d as %s: %v", imageName, projectID, format, err)
+		http.Error(w, "Failed to convert image", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// rasterizeSVG renders an SVG image to PNG with svgRasterizer
+func rasterizeSVG(ctx context.Context, svg []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, svgRasterizer, "--format", "png")
+	cmd.Stdin = bytes.NewReader(svg)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// --- Account Export ---
+
+const (
+	accountExportManifestName = "manifest.json"
+	accountExportVersion      = 1 // Bump when the archive layout changes so imports can tell formats apart
+)
+
+// AccountExportManifest describes the contents of an account export archive
+type AccountExportManifest struct {
+	Version    int                    `json:"version"`
+	ExportedAt time.Time              `json:"exported_at"`
+	Projects   []AccountExportProject `json:"projects"`
+}
+
+// AccountExportProject locates one project inside the archive; files live under Folder
+type AccountExportProject struct {
+	ID             int64             `json:"id"`
+	Name           string            `json:"name"`
+	ContentType    string            `json:"content_type,omitempty"` // Missing in older exports, meaning image/svg+xml
+	Archived       bool              `json:"archived"`
+	Folder         string            `json:"folder"`
+	Body           string            `json:"body"`                      // Path of the body file
+	Images         []string          `json:"images"`                    // Image names, stored under Folder/images/
+	ExternalImages map[string]string `json:"external_images,omitempty"` // Name -> URL of externally hosted images, which have no file
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+// safeFileName reduces a user-supplied name to characters that are safe in archive paths
+func safeFileName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+		if b.Len() >= 64 {
+			break
+		}
+	}
+	safe := strings.Trim(b.String(), ".")
+	if safe == "" {
+		safe = "untitled"
+	}
+	return safe
+}
+
+// GET /api/account/export (Authenticated)
+// Streams every project of the user as a zip: one folder per project with its body and images,
+// plus a top-level manifest.json written last
+func exportAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+
+	dbMutex.Lock()
+	rows, err := db.Query("SELECT id, name, content_type, archived, created_at, updated_at FROM projects WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		dbMutex.Unlock()
+		logErrorf("Error querying projects for export of user %d: %v", userID, err)
+		http.Error(w, "Failed to export projects", http.StatusInternalServerError)
+		return
+	}
+	projects := []AccountExportProject{}
+	for rows.Next() {
+		var p AccountExportProject
+		if err = rows.Scan(&p.ID, &p.Name, &p.ContentType, &p.Archived, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			break
+		}
+		projects = append(projects, p)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	dbMutex.Unlock()
+	if err != nil {
+		logErrorf("Error reading projects for export of user %d: %v", userID, err)
+		http.Error(w, "Failed to export projects", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"underlog-export-%s.zip\"", time.Now().UTC().Format("20060102")))
+	w.WriteHeader(http.StatusOK)
+
+	// Headers are sent, so errors from here on can only be logged and the archive truncated
+	zw := zip.NewWriter(w)
+	exported := []AccountExportProject{}
+	for _, p := range projects {
+		p.Folder = fmt.Sprintf("%d-%s", p.ID, safeFileName(p.Name))
+		p.Body = p.Folder + "/body.txt"
+
+		var body string
+		var images []projectImageRef
+		dbMutex.Lock()
+		err := db.QueryRow("SELECT body FROM projects WHERE id = ? AND user_id = ?", p.ID, userID).Scan((*storedBody)(&body))
+		if err == nil {
+			images, err = projectImageRefs(p.ID)
+		}
+		dbMutex.Unlock()
 		if err == sql.ErrNoRows {
-			log.Printf("Login attempt failed for %s: user not found", req.Username)
-			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			continue // Deleted while exporting
+		}
+		if err != nil {
+			logErrorf("Error reading project %d for export: %v", p.ID, err)
+			return
+		}
+
+		if err := writeZipEntry(zw, p.Body, []byte(body), p.UpdatedAt); err != nil {
+			logErrorf("Error writing body of project %d to export: %v", p.ID, err)
+			return
+		}
+		p.Images = []string{}
+		for _, img := range images {
+			if img.key == "" { // Externally hosted: only the URL goes into the manifest
+				if p.ExternalImages == nil {
+					p.ExternalImages = make(map[string]string)
+				}
+				p.ExternalImages[img.name] = img.url
+				continue
+			}
+			blob, err := loadImage(img.key)
+			if err != nil {
+				logErrorf("Error reading image '%s' of project %d for export: %v", img.name, p.ID, err)
+				return
+			}
+			if err := writeZipEntry(zw, p.Folder+"/images/"+img.name, blob, p.UpdatedAt); err != nil {
+				logErrorf("Error writing image '%s' of project %d to export: %v", img.name, p.ID, err)
+				return
+			}
+			p.Images = append(p.Images, img.name)
+		}
+		exported = append(exported, p)
+	}
+
+	manifest, err := json.MarshalIndent(AccountExportManifest{Version: accountExportVersion, ExportedAt: time.Now().UTC(), Projects: exported}, "", "  ")
+	if err == nil {
+		err = writeZipEntry(zw, accountExportManifestName, manifest, time.Now())
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		logErrorf("Error finishing export for user %d: %v", userID, err)
+		return
+	}
+	log.Printf("Exported %d projects for user %d", len(exported), userID)
+}
+
+// writeZipEntry adds a single compressed file to a zip archive
+func writeZipEntry(zw *zip.Writer, name string, data []byte, modified time.Time) error {
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+// --- Account Import ---
+
+// AccountImportResult reports what an account import created
+type AccountImportResult struct {
+	Imported []ImportedProject `json:"imported"`
+	Skipped  []string          `json:"skipped"`  // Names of projects that already existed (on_conflict=skip)
+	Failed   []FailedImport    `json:"failed"`   // Projects that could not be imported; the others still were (mode=merge)
+	Replaced int               `json:"replaced"` // Existing projects deleted (mode=replace)
+}
+
+type FailedImport struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+type ImportedProject struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	OriginalName string `json:"original_name"`
+	ImageCount   int    `json:"image_count"`
+}
+
+// validArchivePath rejects absolute paths, backslashes and any ".." components
+func validArchivePath(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// readZipFile reads an archive entry, refusing entries larger than limit bytes
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s exceeds %d bytes", f.Name, limit)
+	}
+	return data, nil
+}
+
+// userStorageBytes returns the bytes used by a user's project bodies and images. The caller must hold dbMutex.
+func userStorageBytes(userID int64) (int64, error) {
+	var total int64
+	err := db.QueryRow(
+		"SELECT COALESCE((SELECT SUM("+plainBodyLength("body")+") FROM projects WHERE user_id = ?), 0) + "+
+			"COALESCE((SELECT SUM(i.size) FROM images i JOIN projects p ON p.id = i.project_id WHERE p.user_id = ?), 0)",
+		userID, userID,
+	).Scan(&total)
+	return total, err
+}
+
+// projectStorageBytes returns the plain body length of a user's project and the size of each of
+// its images by name. The caller must hold dbMutex.
+func projectStorageBytes(projectID, userID int64) (int64, map[string]int64, error) {
+	var bodyBytes int64
+	err := db.QueryRow("SELECT "+plainBodyLength("body")+" FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&bodyBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+	rows, err := db.Query("SELECT name, size FROM images WHERE project_id = ?", projectID)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var size int64
+		if err := rows.Scan(&name, &size); err != nil {
+			return 0, nil, err
+		}
+		sizes[name] = size
+	}
+	return bodyBytes, sizes, rows.Err()
+}
+
+// quotaExceededError reports a write that would take a user past UNDERLOG_USER_QUOTA_BYTES
+type quotaExceededError struct {
+	needed, remaining int64
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("Storage quota exceeded: %d more bytes needed but only %d of the %d byte quota remain", e.needed, e.remaining, cfg.UserQuotaBytes)
+}
+
+// userQuotaError returns a *quotaExceededError if storing delta more bytes of bodies and images
+// would take a user past UNDERLOG_USER_QUOTA_BYTES. Shrinking writes (delta <= 0) always pass.
+// The caller must hold dbMutex from the check through its writes, so concurrent writes can't both fit.
+func userQuotaError(userID, delta int64) error {
+	if cfg.UserQuotaBytes <= 0 || delta <= 0 {
+		return nil
+	}
+	used, err := userStorageBytes(userID)
+	if err != nil {
+		return fmt.Errorf("computing storage usage: %w", err)
+	}
+	if used+delta > cfg.UserQuotaBytes {
+		return &quotaExceededError{needed: delta, remaining: max(cfg.UserQuotaBytes-used, 0)}
+	}
+	return nil
+}
+
+// checkUserQuota is userQuotaError for handlers: it writes 413 when the quota would be exceeded,
+// or 500 when usage can't be computed, and reports whether the write may go ahead
+func checkUserQuota(w http.ResponseWriter, userID, delta int64) bool {
+	err := userQuotaError(userID, delta)
+	var quotaErr *quotaExceededError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &quotaErr):
+		http.Error(w, quotaErr.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		logErrorf("Error checking storage quota of user %d: %v", userID, err)
+		http.Error(w, "Failed to check storage quota", dbErrorStatus(err))
+	}
+	return false
+}
+
+// uniqueProjectName returns name, or name with a " (n)" suffix if the user already has a project
+// called name (ignoring case when UNDERLOG_CASE_INSENSITIVE_NAMES is on). The caller must hold dbMutex.
+func uniqueProjectName(q rowsQuerier, userID int64, name string) (string, error) {
+	candidate := name
+	for n := 2; ; n++ {
+		var exists bool
+		err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM projects WHERE user_id = ? AND name = ?)", userID, candidate).Scan(&exists)
+		if err == nil && !exists {
+			var collision string
+			collision, err = findCaseCollision(q, candidate, "SELECT name FROM projects WHERE user_id = ?", userID)
+			exists = collision != ""
+		}
+		if err != nil || !exists {
+			return candidate, err
+		}
+		candidate = fmt.Sprintf("%s (%d)", name, n)
+	}
+}
+
+// POST /api/account/import?mode=merge|replace&on_conflict=rename|skip (Authenticated)
+// Recreates the projects of an account export zip. mode=merge (the default) keeps existing projects,
+// resolves name conflicts with on_conflict and imports each project in its own transaction, so one
+// bad project does not stop the rest. mode=replace deletes all of the user's projects and imports
+// the archive in a single transaction: if any project fails, nothing is deleted or imported.
+func importAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		http.Error(w, "mode must be 'merge' or 'replace'", http.StatusBadRequest)
+		return
+	}
+	onConflict := r.URL.Query().Get("on_conflict")
+	if onConflict == "" {
+		onConflict = "rename"
+	}
+	if onConflict != "rename" && onConflict != "skip" {
+		http.Error(w, "on_conflict must be 'rename' or 'skip'", http.StatusBadRequest)
+		return
+	}
+
+	// Spool the upload to disk: zip needs random access and archives can be large
+	tmp, err := os.CreateTemp("", "underlog-import-")
+	if err != nil {
+		logErrorf("Failed to create temp file for import of user %d: %v", userID, err)
+		http.Error(w, "Failed to process import", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, cfg.MaxImportBytes))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("Import archive exceeds the limit of %d bytes", cfg.MaxImportBytes), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Failed to read import archive", http.StatusBadRequest)
+		}
+		return
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		http.Error(w, "Invalid zip archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		if !validArchivePath(f.Name) && !strings.HasSuffix(f.Name, "/") {
+			http.Error(w, fmt.Sprintf("Invalid path in archive: %q", f.Name), http.StatusBadRequest)
+			return
+		}
+		files[f.Name] = f
+	}
+
+	manifestFile, ok := files[accountExportManifestName]
+	if !ok {
+		http.Error(w, "Archive has no "+accountExportManifestName, http.StatusBadRequest)
+		return
+	}
+	manifestBytes, err := readZipFile(manifestFile, 16<<20)
+	if err != nil {
+		http.Error(w, "Failed to read manifest: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var manifest AccountExportManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		http.Error(w, "Invalid manifest: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if manifest.Version < 1 || manifest.Version > accountExportVersion {
+		http.Error(w, fmt.Sprintf("Unsupported export format version %d, this server reads versions 1-%d", manifest.Version, accountExportVersion), http.StatusBadRequest)
+		return
+	}
+
+	// Validate every referenced file and total the incoming size before touching the database
+	var incoming int64
+	for i, p := range manifest.Projects {
+		if _, err := validateProjectName(p.Name); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid project name %q: %v", p.Name, err), http.StatusBadRequest)
+			return
+		}
+		if err := validateProjectContentType(p.ContentType); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid content type of project %q: %v", p.Name, err), http.StatusBadRequest)
+			return
+		}
+		paths := []string{p.Body}
+		for _, name := range p.Images {
+			if err := validateImageName(name); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid image name %q in project %q: %v", name, p.Name, err), http.StatusBadRequest)
+				return
+			}
+			paths = append(paths, p.Folder+"/images/"+name)
+		}
+		for name, imageURL := range p.ExternalImages {
+			if err := validateImageName(name); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid image name %q in project %q: %v", name, p.Name, err), http.StatusBadRequest)
+				return
+			}
+			if slices.Contains(p.Images, name) {
+				http.Error(w, fmt.Sprintf("Image %q in project %q is listed as both stored and external", name, p.Name), http.StatusBadRequest)
+				return
+			}
+			if err := validateImageURL(imageURL); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid url for image %q in project %q: %v", name, p.Name, err), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, path := range paths {
+			f, ok := files[path]
+			if !validArchivePath(path) || !ok {
+				http.Error(w, fmt.Sprintf("Project %d in manifest references missing or invalid file %q", i, path), http.StatusBadRequest)
+				return
+			}
+			incoming += int64(f.UncompressedSize64)
+		}
+	}
+
+	if mode == "replace" && cfg.UserQuotaBytes > 0 && incoming > cfg.UserQuotaBytes {
+		// Nothing stays in use when replacing; merges are checked against current usage below
+		http.Error(w, fmt.Sprintf("Import needs %d bytes but the quota is %d bytes", incoming, cfg.UserQuotaBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	result := AccountImportResult{Imported: []ImportedProject{}, Skipped: []string{}, Failed: []FailedImport{}}
+	if mode == "replace" {
+		var deleted []ProjectListItem
+		var keys, deletedKeys []string // Storage keys of the images stored for the import and of the deleted ones
+		var failed *FailedImport
+		dbMutex.Lock()
+		images := make([]importImages, len(manifest.Projects))
+		for i, p := range manifest.Projects {
+			if images[i], err = storeImportImages(p, files); err != nil {
+				failed = &FailedImport{Name: p.Name, Error: err.Error()}
+			}
+			keys = append(keys, images[i].keys...)
+			if failed != nil {
+				break
+			}
+		}
+		if failed == nil {
+			err = withWriteTx(r.Context(), func(tx *sql.Tx) error {
+				var err error
+				if deleted, deletedKeys, err = deleteAllProjects(r.Context(), tx, userID); err != nil {
+					return err
+				}
+				for i, p := range manifest.Projects {
+					imported, skipped, err := importProject(r.Context(), tx, userID, p, images[i], files, onConflict)
+					if err != nil {
+						failed = &FailedImport{Name: p.Name, Error: err.Error()}
+						return err
+					}
+					if skipped {
+						result.Skipped = append(result.Skipped, p.Name)
+					} else {
+						result.Imported = append(result.Imported, imported)
+					}
+				}
+				return nil
+			})
+		}
+		releaseImageKeys(append(keys, deletedKeys...)) // Frees whatever the outcome left unreferenced
+		dbMutex.Unlock()
+		if failed != nil {
+			logErrorf("Error importing project '%s' for user %d, existing projects kept: %s", failed.Name, userID, failed.Error)
+			http.Error(w, fmt.Sprintf("Failed to import project %q: %s; existing projects were kept", failed.Name, failed.Error), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			logErrorf("Error replacing projects of user %d: %v", userID, err)
+			http.Error(w, "Failed to replace existing projects", dbErrorStatus(err))
+			return
+		}
+		for _, p := range deleted {
+			projectCache.invalidate(p.ID)
+			go notifyWebhooks(userID, webhookEventProjectDeleted, p.ID, p.Name)
+		}
+		result.Replaced = len(deleted)
+	} else {
+		// Held from the quota check through the last write, so concurrent imports can't both fit
+		dbMutex.Lock()
+		if !checkUserQuota(w, userID, incoming) {
+			dbMutex.Unlock()
+			return
+		}
+		for _, p := range manifest.Projects {
+			var imported ImportedProject
+			var skipped bool
+			images, err := storeImportImages(p, files)
+			if err == nil {
+				err = withWriteTx(r.Context(), func(tx *sql.Tx) (err error) {
+					imported, skipped, err = importProject(r.Context(), tx, userID, p, images, files, onConflict)
+					return err
+				})
+			}
+			releaseImageKeys(images.keys)
+			if err != nil {
+				// Each project has its own transaction, so the rest of the archive can still be imported
+				logErrorf("Error importing project '%s' for user %d: %v", p.Name, userID, err)
+				result.Failed = append(result.Failed, FailedImport{Name: p.Name, Error: err.Error()})
+				continue
+			}
+			if skipped {
+				result.Skipped = append(result.Skipped, p.Name)
+				continue
+			}
+			result.Imported = append(result.Imported, imported)
+		}
+		dbMutex.Unlock()
+	}
+	for _, imported := range result.Imported {
+		go notifyWebhooks(userID, webhookEventProjectCreated, imported.ID, imported.Name)
+	}
+
+	log.Printf("Imported %d projects (%d skipped, %d failed, %d replaced) for user %d", len(result.Imported), len(result.Skipped), len(result.Failed), result.Replaced, userID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// deleteAllProjects deletes every project of a user within tx. It returns what was deleted and the
+// storage keys of the deleted images, for releaseImageKeys once the transaction has ended.
+func deleteAllProjects(ctx context.Context, tx *sql.Tx, userID int64) ([]ProjectListItem, []string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, name FROM projects WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var projects []ProjectListItem
+	for rows.Next() {
+		var p ProjectListItem
+		if err := rows.Scan(&p.ID, &p.Name); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		projects = append(projects, p)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var imageKeys []string
+	rows, err = tx.QueryContext(ctx,
+		"SELECT i.storage_key FROM images i JOIN projects p ON p.id = i.project_id WHERE p.user_id = ? AND i.storage_key IS NOT NULL", userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		imageKeys = append(imageKeys, key)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Images are removed by the ON DELETE CASCADE foreign key
+	if _, err := tx.ExecContext(ctx, "DELETE FROM projects WHERE user_id = ?", userID); err != nil {
+		return nil, nil, err
+	}
+	return projects, imageKeys, nil
+}
+
+// importImages holds the storage keys and sizes of one project's images, stored by storeImportImages
+type importImages struct {
+	keys  []string
+	sizes []int
+}
+
+// storeImportImages checks a project's images and puts their bytes in the image store. It must run
+// before the import transaction, since the SQLite image store writes through its own connection.
+// The keys are returned also on failure, for releaseImageKeys once the import has ended.
+// The caller must hold dbMutex.
+func storeImportImages(p AccountExportProject, files map[string]*zip.File) (importImages, error) {
+	var images importImages
+	if err := imageCountError(len(p.Images) + len(p.ExternalImages)); err != nil {
+		return images, err
+	}
+	if a, b, ok := findFoldedDuplicate(append(slices.Clone(p.Images), slices.Collect(maps.Keys(p.ExternalImages))...)); ok {
+		return images, fmt.Errorf("image names %q and %q differ only in case", a, b)
+	}
+	imageLimit := int64(1 << 30)
+	if cfg.MaxImageBytes > 0 {
+		imageLimit = int64(cfg.MaxImageBytes)
+	}
+	for _, imageName := range p.Images {
+		blob, err := readZipFile(files[p.Folder+"/images/"+imageName], imageLimit)
+		if err != nil {
+			return images, err
+		}
+		if err := checkImageContent(imageName, blob); err != nil {
+			return images, fmt.Errorf("image %q: %w", imageName, err)
+		}
+		key, err := storeImage(blob)
+		if err != nil {
+			return images, err
+		}
+		images.keys = append(images.keys, key)
+		images.sizes = append(images.sizes, len(blob))
+	}
+	return images, nil
+}
+
+// importProject creates one project from an export archive within tx, referencing images already
+// stored by storeImportImages. It reports true when the project was skipped (on_conflict=skip).
+// The caller must hold dbMutex.
+func importProject(ctx context.Context, tx *sql.Tx, userID int64, p AccountExportProject, images importImages, files map[string]*zip.File, onConflict string) (ImportedProject, bool, error) {
+	imported := ImportedProject{OriginalName: p.Name, ImageCount: len(p.Images) + len(p.ExternalImages)}
+
+	bodyLimit := int64(1 << 30)
+	if cfg.MaxBodyBytes > 0 {
+		bodyLimit = int64(cfg.MaxBodyBytes)
+	}
+	body, err := readZipFile(files[p.Body], bodyLimit)
+	if err != nil {
+		return imported, false, err
+	}
+	name, _ := validateProjectName(p.Name)
+	if name == "" {
+		name = defaultProjectName
+	}
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM projects WHERE user_id = ? AND name = ?)", userID, name).Scan(&exists); err != nil {
+		return imported, false, err
+	}
+	if exists && onConflict == "skip" {
+		return imported, true, nil
+	}
+	if name, err = uniqueProjectName(tx, userID, name); err != nil {
+		return imported, false, err
+	}
+	imported.Name = name
+
+	sealed, err := sealBody(string(body))
+	if err != nil {
+		return imported, false, err
+	}
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO projects (user_id, name, content_type, body, archived, updated_at) VALUES (?, ?, COALESCE(NULLIF(?, ''), ?), ?, ?, ?)",
+		userID, name, p.ContentType, svgContentType, sealed, p.Archived, time.Now(),
+	)
+	if err != nil {
+		return imported, false, err
+	}
+	if imported.ID, err = result.LastInsertId(); err != nil {
+		return imported, false, err
+	}
+	for i, imageName := range p.Images {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO images (project_id, name, blob, content_hash, storage_key, size) VALUES (?, ?, X'', ?, ?, ?)",
+			imported.ID, imageName, images.keys[i], images.keys[i], images.sizes[i],
+		); err != nil {
+			return imported, false, err
+		}
+	}
+	for imageName, imageURL := range p.ExternalImages {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO images (project_id, name, blob, url, size) VALUES (?, ?, X'', ?, 0)",
+			imported.ID, imageName, imageURL,
+		); err != nil {
+			return imported, false, err
+		}
+	}
+	return imported, false, nil
+}
+
+// --- Project Cache ---
+
+// projectCacheEntry is a serialized ProjectDetail response
+type projectCacheEntry struct {
+	projectID    int64
+	userID       int64
+	lastModified time.Time
+	body         []byte
+	generation   uint64 // From projectLRU.generation while the project was read
+}
+
+// projectLRU is a size-bounded least-recently-used cache of project detail responses.
+// A capacity of zero disables it.
+type projectLRU struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[int64]*list.Element
+	order    *list.List       // Front is most recently used
+	gens     map[int64]uint64 // Bumped by invalidate, so a put of an older read is ignored
+	hits     uint64
+	misses   uint64
+}
+
+// ProjectCacheStats reports the project cache's size and hit rate
+type ProjectCacheStats struct {
+	Enabled  bool   `json:"enabled"`
+	Capacity int    `json:"capacity"`
+	Size     int    `json:"size"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+}
+
+var projectCache *projectLRU
+
+func newProjectLRU(capacity int) *projectLRU {
+	return &projectLRU{capacity: capacity, items: make(map[int64]*list.Element), order: list.New(), gens: make(map[int64]uint64)}
+}
+
+// generation returns the project's invalidation count; read it under dbMutex together with the
+// project and pass it to put, which drops the entry if the project changed in between
+func (c *projectLRU) generation(projectID int64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gens[projectID]
+}
+
+func (c *projectLRU) get(projectID int64) (projectCacheEntry, bool) {
+	if c.capacity <= 0 {
+		return projectCacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[projectID]
+	if !ok {
+		c.misses++
+		return projectCacheEntry{}, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(projectCacheEntry), true
+}
+
+func (c *projectLRU) put(entry projectCacheEntry) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gens[entry.projectID] != entry.generation {
+		return // Invalidated since the entry was read
+	}
+	if elem, ok := c.items[entry.projectID]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[entry.projectID] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(projectCacheEntry).projectID)
+	}
+}
+
+// invalidate drops a project after it changes; call it before releasing dbMutex
+func (c *projectLRU) invalidate(projectID int64) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gens[projectID]++
+	if elem, ok := c.items[projectID]; ok {
+		c.order.Remove(elem)
+		delete(c.items, projectID)
+	}
+}
+
+func (c *projectLRU) stats() ProjectCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ProjectCacheStats{Enabled: c.capacity > 0, Capacity: c.capacity, Size: c.order.Len(), Hits: c.hits, Misses: c.misses}
+}
+
+// GET /api/admin/cache (Admin)
+func getProjectCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projectCache.stats())
+}
+
+// VacuumResult reports the database file size around a VACUUM
+type VacuumResult struct {
+	SizeBefore int64   `json:"size_before"`
+	SizeAfter  int64   `json:"size_after"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// POST /api/admin/vacuum (Admin)
+// Rebuilds the database file to reclaim space left by deletions. VACUUM needs exclusive access,
+// so all other database work waits on dbMutex until it finishes, which may take a while on large databases.
+func vacuumHandler(w http.ResponseWriter, r *http.Request) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	sizeBefore, err := databaseFileSize()
+	if err != nil {
+		logErrorf("Error reading database size before VACUUM: %v", err)
+		http.Error(w, "Failed to read database size", http.StatusInternalServerError)
+		return
+	}
+
+	// Run both statements on one pooled connection; nothing else holds a transaction while dbMutex is held
+	conn, err := db.Conn(r.Context())
+	if err != nil {
+		logErrorf("Error acquiring connection for VACUUM: %v", err)
+		http.Error(w, "Failed to vacuum database", dbErrorStatus(err))
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	log.Printf("Running VACUUM on %s (%d bytes)", dbFileName, sizeBefore)
+	if _, err := conn.ExecContext(r.Context(), "VACUUM"); err != nil {
+		logErrorf("Error running VACUUM: %v", err)
+		http.Error(w, "Failed to vacuum database", dbErrorStatus(err))
+		return
+	}
+	// Only has an effect in WAL mode, where the rebuilt pages first land in the -wal file
+	if _, err := conn.ExecContext(r.Context(), "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		logErrorf("Error checkpointing WAL after VACUUM: %v", err)
+	}
+
+	result := VacuumResult{SizeBefore: sizeBefore, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+	if result.SizeAfter, err = databaseFileSize(); err != nil {
+		logErrorf("Error reading database size after VACUUM: %v", err)
+		http.Error(w, "Failed to read database size", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("VACUUM finished in %.0fms: %d -> %d bytes", result.DurationMS, result.SizeBefore, result.SizeAfter)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// databaseFileSize returns the size of the database file plus its WAL file, if any
+func databaseFileSize() (int64, error) {
+	info, err := os.Stat(dbFileName)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if wal, err := os.Stat(dbFileName + "-wal"); err == nil {
+		size += wal.Size()
+	}
+	return size, nil
+}
+
+// --- Chunked Image Uploads ---
+
+// chunkedUpload tracks a partially received image assembled in a temp file
+type chunkedUpload struct {
+	mu       sync.Mutex
+	path     string
+	total    int64
+	received [][2]int64 // Sorted, merged, inclusive byte ranges
+	updated  time.Time  // When the last chunk was written
+}
+
+var (
+	uploads      = make(map[string]*chunkedUpload)
+	uploadsMutex sync.Mutex
+)
+
+// UploadStatus reports the byte ranges received so far for a chunked upload
+type UploadStatus struct {
+	Total    int64      `json:"total"`
+	Received [][2]int64 `json:"received"`
+	Complete bool       `json:"complete"`
+}
+
+// removeStaleUploads discards chunked uploads that received no chunk within UNDERLOG_UPLOAD_EXPIRY,
+// along with upload temp files no upload refers to, such as those left behind by a restart
+func removeStaleUploads() {
+	cutoff := time.Now().Add(-cfg.UploadExpiry)
+	live := make(map[string]bool)
+	uploadsMutex.Lock()
+	for key, upload := range uploads {
+		if !upload.mu.TryLock() {
+			live[upload.path] = true // A chunk is being written right now
+			continue
+		}
+		if upload.updated.Before(cutoff) {
+			delete(uploads, key)
+			os.Remove(upload.path)
+			log.Printf("Discarded chunked upload %s after %v without a chunk", key, cfg.UploadExpiry)
 		} else {
-			log.Printf("Error querying user %s: %v", req.Username, err)
-			http.Error(w, "Login failed", http.StatusInternalServerError)
+			live[upload.path] = true
+		}
+		upload.mu.Unlock()
+	}
+	uploadsMutex.Unlock()
+
+	entries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		logErrorf("Error reading temp directory: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(os.TempDir(), entry.Name())
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), uploadTempPrefix) || live[path] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue // Possibly created by an upload that started after the scan above
+		}
+		if err := os.Remove(path); err != nil {
+			logErrorf("Failed to remove stale upload temp file %s: %v", path, err)
+			continue
+		}
+		log.Printf("Removed stale upload temp file %s", path)
+	}
+}
+
+func uploadKey(projectID int64, imageName string) string {
+	return fmt.Sprintf("%d/%s", projectID, imageName)
+}
+
+// parseContentRange parses a "bytes start-end/total" header value
+func parseContentRange(header string) (start, end, total int64, err error) {
+	if _, err = fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if start < 0 || end < start || end >= total {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return start, end, total, nil
+}
+
+// addRange records [start, end] as received, merging overlapping or adjacent ranges
+func (u *chunkedUpload) addRange(start, end int64) {
+	ranges := append(u.received, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, rg := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rg[0] <= last[1]+1 {
+			if rg[1] > last[1] {
+				last[1] = rg[1]
+			}
+		} else {
+			merged = append(merged, rg)
+		}
+	}
+	u.received = merged
+}
+
+func (u *chunkedUpload) complete() bool {
+	return len(u.received) == 1 && u.received[0][0] == 0 && u.received[0][1] == u.total-1
+}
+
+func (u *chunkedUpload) status() UploadStatus {
+	received := make([][2]int64, len(u.received))
+	copy(received, u.received)
+	return UploadStatus{Total: u.total, Received: received, Complete: u.complete()}
+}
+
+// GET /api/projects/{id}/images/{image_name}/upload (Authenticated)
+// Reports the ranges already received so an interrupted upload can resume
+func getUploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	imageName := mux.Vars(r)["image_name"]
+
+	dbMutex.Lock()
+	owned := requireProjectOwner(w, projectID, userID)
+	dbMutex.Unlock()
+	if !owned {
+		return
+	}
+
+	uploadsMutex.Lock()
+	upload, exists := uploads[uploadKey(projectID, imageName)]
+	uploadsMutex.Unlock()
+	if !exists {
+		http.Error(w, "No upload in progress", http.StatusNotFound)
+		return
+	}
+
+	upload.mu.Lock()
+	status := upload.status()
+	upload.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// POST /api/projects/{id}/images/{image_name}/upload (Authenticated)
+// Accepts one raw chunk described by Content-Range; the image is stored once all bytes arrive
+func uploadImageChunkHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	imageName := mux.Vars(r)["image_name"]
+	defer r.Body.Close()
+
+	if err := validateImageName(imageName); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid image name %q: %v", imageName, err), http.StatusBadRequest)
+		return
+	}
+	if imageContentType(imageName) == "application/octet-stream" {
+		http.Error(w, fmt.Sprintf("Unsupported image extension %q", filepath.Ext(imageName)), http.StatusBadRequest)
+		return
+	}
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	uploadLimit := int64(maxChunkedUploadBytes)
+	if cfg.MaxImageBytes > 0 {
+		uploadLimit = int64(cfg.MaxImageBytes)
+	}
+	if total > uploadLimit {
+		http.Error(w, fmt.Sprintf("Image is %d bytes, exceeding the limit of %d bytes", total, uploadLimit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	chunkLen := end - start + 1
+	if cfg.MaxUploadChunkBytes > 0 && chunkLen > cfg.MaxUploadChunkBytes {
+		http.Error(w, fmt.Sprintf("Chunk is %d bytes, exceeding the limit of %d bytes", chunkLen, cfg.MaxUploadChunkBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, chunkLen)
+
+	dbMutex.Lock()
+	owned := requireProjectOwner(w, projectID, userID)
+	var count int
+	var exists bool
+	var replacedSize int64
+	var collision string
+	if owned {
+		err = db.QueryRow(
+			"SELECT COUNT(*), COALESCE(SUM(name = ?), 0) > 0, COALESCE(SUM(CASE WHEN name = ? THEN size END), 0) FROM images WHERE project_id = ?",
+			imageName, imageName, projectID,
+		).Scan(&count, &exists, &replacedSize)
+		if err == nil {
+			collision, err = findCaseCollision(db, imageName, "SELECT name FROM images WHERE project_id = ?", projectID)
+		}
+	}
+	if owned && err == nil {
+		// Checked again when the upload completes; this only spares uploading an image that can't fit
+		owned = checkUserQuota(w, userID, total-replacedSize)
+	}
+	dbMutex.Unlock()
+	if !owned {
+		return
+	}
+	if err != nil {
+		logErrorf("Error counting images of project %d: %v", projectID, err)
+		http.Error(w, "Failed to process upload", http.StatusInternalServerError)
+		return
+	}
+	if collision != "" {
+		http.Error(w, fmt.Sprintf("Image name differs from existing image %q only in case", collision), http.StatusConflict)
+		return
+	}
+	if !exists && !checkImageCount(w, count+1) { // Replacing an image does not add one
+		return
+	}
+
+	key := uploadKey(projectID, imageName)
+	uploadsMutex.Lock()
+	upload, exists := uploads[key]
+	if !exists || upload.total != total {
+		if exists {
+			// Total size changed, so the client restarted with a different image
+			os.Remove(upload.path)
+		}
+		f, err := os.CreateTemp("", uploadTempPrefix)
+		if err != nil {
+			uploadsMutex.Unlock()
+			logErrorf("Failed to create temp file for upload %s: %v", key, err)
+			http.Error(w, "Failed to process upload", http.StatusInternalServerError)
+			return
+		}
+		f.Close()
+		upload = &chunkedUpload{path: f.Name(), total: total, updated: time.Now()}
+		uploads[key] = upload
+		log.Printf("Started chunked upload of '%s' (%d bytes) for project %d", imageName, total, projectID)
+	}
+	uploadsMutex.Unlock()
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	f, err := os.OpenFile(upload.path, os.O_WRONLY, 0600)
+	if err != nil {
+		logErrorf("Failed to open temp file for upload %s: %v", key, err)
+		http.Error(w, "Failed to process upload", http.StatusInternalServerError)
+		return
+	}
+	written, err := io.Copy(io.NewOffsetWriter(f, start), r.Body)
+	f.Close()
+	upload.updated = time.Now()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("Chunk body is longer than the %d bytes Content-Range expects", chunkLen), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logErrorf("Error writing chunk %d-%d for upload %s: %v", start, end, key, err)
+		http.Error(w, "Failed to read chunk", http.StatusInternalServerError)
+		return
+	}
+	if written != chunkLen {
+		http.Error(w, fmt.Sprintf("Chunk body has %d bytes, Content-Range expects %d", written, chunkLen), http.StatusBadRequest)
+		return
+	}
+	upload.addRange(start, end)
+
+	if !upload.complete() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(upload.status())
+		return
+	}
+
+	// All bytes received: move the assembled file into the image store
+	blob, err := os.ReadFile(upload.path)
+	if err != nil {
+		logErrorf("Failed to read assembled upload %s: %v", key, err)
+		http.Error(w, "Failed to process upload", http.StatusInternalServerError)
+		return
+	}
+	if err := checkImageContent(imageName, blob); err != nil {
+		uploadsMutex.Lock()
+		delete(uploads, key)
+		uploadsMutex.Unlock()
+		os.Remove(upload.path)
+		http.Error(w, fmt.Sprintf("Image %q rejected: %v", imageName, err), http.StatusBadRequest)
+		return
+	}
+
+	unlockProject := lockProject(projectID)
+	dbMutex.Lock()
+	releaseKeys := []string{}
+	var oldKey sql.NullString
+	var oldSize int64
+	err = db.QueryRow("SELECT storage_key, size FROM images WHERE project_id = ? AND name = ?", projectID, imageName).Scan(&oldKey, &oldSize)
+	if oldKey.Valid {
+		releaseKeys = append(releaseKeys, oldKey.String) // Freed if the replacement leaves it unreferenced
+	}
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err == nil {
+		err = userQuotaError(userID, int64(len(blob))-oldSize)
+	}
+	var newKey, projectName string
+	if err == nil {
+		newKey, err = storeImage(blob)
+	}
+	if err == nil {
+		releaseKeys = append(releaseKeys, newKey) // Freed if the insert fails
+		err = withWriteTx(r.Context(), func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(r.Context(),
+				"INSERT OR REPLACE INTO images (project_id, name, blob, content_hash, storage_key, size) VALUES (?, ?, X'', ?, ?, ?)",
+				projectID, imageName, newKey, newKey, len(blob),
+			); err != nil {
+				return err
+			}
+			if err := tx.QueryRowContext(r.Context(), "SELECT name FROM projects WHERE id = ?", projectID).Scan(&projectName); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(r.Context(), "UPDATE projects SET updated_at = ? WHERE id = ?", time.Now(), projectID); err != nil {
+				return err
+			}
+			return recordProjectVersion(r.Context(), tx, projectID)
+		})
+	}
+	releaseImageKeys(releaseKeys)
+	projectCache.invalidate(projectID)
+	dbMutex.Unlock()
+	unlockProject()
+	var quotaErr *quotaExceededError
+	if errors.As(err, &quotaErr) {
+		http.Error(w, quotaErr.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logErrorf("Error storing uploaded image '%s' for project %d: %v", imageName, projectID, err)
+		http.Error(w, "Failed to store image", dbErrorStatus(err))
+		return
+	}
+
+	uploadsMutex.Lock()
+	delete(uploads, key)
+	uploadsMutex.Unlock()
+	os.Remove(upload.path)
+
+	log.Printf("Completed chunked upload of '%s' (%d bytes) for project %d", imageName, total, projectID)
+	go notifyWebhooks(userID, webhookEventProjectUpdated, projectID, projectName)
+	recordAudit(r, userID, auditActionProjectUpdate, projectID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(upload.status())
+}
+
+// --- Webhooks ---
+
+const (
+	webhookEventProjectCreated = "project.created"
+	webhookEventProjectUpdated = "project.updated"
+	webhookEventProjectDeleted = "project.deleted"
+	webhookMaxAttempts         = 4
+	webhookQueueSize           = 256
+	webhookWorkers             = 4
+)
+
+var webhookEvents = []string{webhookEventProjectCreated, webhookEventProjectUpdated, webhookEventProjectDeleted}
+
+// Webhook is a user-registered URL notified about project changes. The secret is only
+// returned when the webhook is created.
+type Webhook struct {
+	ID     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events"`
+}
+
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"` // Empty subscribes to all events
+}
+
+// WebhookPayload is the JSON body POSTed to webhook URLs
+type WebhookPayload struct {
+	Event       string    `json:"event"`
+	UserID      int64     `json:"user_id"`
+	ProjectID   int64     `json:"project_id"`
+	ProjectName string    `json:"project_name"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type webhookDelivery struct {
+	webhookID int64
+	url       string
+	secret    string
+	event     string
+	body      []byte
+}
+
+// errWebhookAddressBlocked is returned when a webhook host resolves to an internal address
+var errWebhookAddressBlocked = errors.New("webhook address is loopback, private or link-local")
+
+var (
+	webhookQueue  = make(chan webhookDelivery, webhookQueueSize)
+	webhookClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// No proxy: the address check below has to see the real destination
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: webhookDialControl,
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+)
+
+// webhookDialControl refuses connections to internal addresses. It runs after DNS resolution for
+// every dial, redirects included, so a hostname cannot be pointed at the server's own network.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	if cfg.WebhookAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", errWebhookAddressBlocked, host)
+	}
+	return nil
+}
+
+// startWebhookWorkers launches the goroutines that deliver queued webhooks
+func startWebhookWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for delivery := range webhookQueue {
+				deliverWebhook(delivery)
+			}
+		}()
+	}
+}
+
+// deliverWebhook POSTs the payload, retrying with exponential backoff on errors and non-2xx responses
+func deliverWebhook(d webhookDelivery) {
+	mac := hmac.New(sha256.New, []byte(d.secret))
+	mac.Write(d.body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := time.Second
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.body))
+		if err != nil {
+			logErrorf("Webhook %d: invalid request for %s: %v", d.webhookID, d.url, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "underlog-webhook")
+		req.Header.Set("X-Underlog-Event", d.event)
+		req.Header.Set("X-Underlog-Signature", signature)
+
+		resp, err := webhookClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				logDebugf("Webhook %d: delivered %s to %s", d.webhookID, d.event, d.url)
+				return
+			}
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		if errors.Is(err, errWebhookAddressBlocked) {
+			logErrorf("Webhook %d: not delivering %s to %s: %v", d.webhookID, d.event, d.url, err)
+			return
+		}
+		logWarnf("Webhook %d: attempt %d/%d for %s failed: %v", d.webhookID, attempt, webhookMaxAttempts, d.url, err)
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	logErrorf("Webhook %d: giving up on %s for %s", d.webhookID, d.event, d.url)
+}
+
+// notifyWebhooks publishes event to the project's event streams and queues deliveries for every
+// webhook of the user subscribed to it.
+// It acquires dbMutex itself, so handlers call it in a goroutine.
+func notifyWebhooks(userID int64, event string, projectID int64, projectName string) {
+	body, err := json.Marshal(WebhookPayload{
+		Event:       event,
+		UserID:      userID,
+		ProjectID:   projectID,
+		ProjectName: projectName,
+		Timestamp:   time.Now().UTC(),
+	})
+	if err != nil {
+		logErrorf("Error encoding webhook payload for project %d: %v", projectID, err)
+		return
+	}
+	projectEvents.publish(projectID, event, body) // Open event streams get the same payload
+
+	dbMutex.Lock()
+	rows, err := db.Query("SELECT id, url, secret, events FROM webhooks WHERE user_id = ?", userID)
+	if err != nil {
+		dbMutex.Unlock()
+		logErrorf("Error querying webhooks for user %d: %v", userID, err)
+		return
+	}
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		var events string
+		if err := rows.Scan(&d.webhookID, &d.url, &d.secret, &events); err != nil {
+			logErrorf("Error scanning webhook row for user %d: %v", userID, err)
+			continue
+		}
+		if events != "" && !containsString(strings.Split(events, ","), event) {
+			continue
+		}
+		d.event = event
+		d.body = body
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	dbMutex.Unlock()
+
+	for _, d := range deliveries {
+		select {
+		case webhookQueue <- d:
+		default:
+			logWarnf("Webhook %d: delivery queue full, dropping %s for project %d", d.webhookID, event, projectID)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebhookRequest checks the URL and event names, responding with 400 on failure
+func validateWebhookRequest(w http.ResponseWriter, req *WebhookRequest) bool {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "Webhook URL must be an absolute http(s) URL", http.StatusBadRequest)
+		return false
+	}
+	for _, event := range req.Events {
+		if !containsString(webhookEvents, event) {
+			http.Error(w, fmt.Sprintf("Unknown webhook event %q (valid: %s)", event, strings.Join(webhookEvents, ", ")), http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+// GET /api/webhooks (Authenticated)
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	rows, err := db.Query("SELECT id, url, events FROM webhooks WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		logErrorf("Error querying webhooks for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve webhooks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.URL, &events); err != nil {
+			logErrorf("Error scanning webhook row for user %d: %v", userID, err)
+			http.Error(w, "Failed to retrieve webhooks", http.StatusInternalServerError)
+			return
 		}
+		hook.Events = []string{}
+		if events != "" {
+			hook.Events = strings.Split(events, ",")
+		}
+		webhooks = append(webhooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		logErrorf("Error iterating webhook rows for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve webhooks", http.StatusInternalServerError)
 		return
 	}
 
-	if !checkPasswordHash(req.Password, storedHash) {
-		log.Printf("Login attempt failed for %s: incorrect password", req.Username)
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+// POST /api/webhooks (Authenticated)
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	defer r.Body.Close()
 
-	session, _ := sessionStore.Get(r, sessionKeyName)
-	session.Values[userIDContextKey] = userID
-	session.Options.HttpOnly = true // Prevent client-side script access
-	// session.Options.Secure = true // Enable this if using HTTPS
-	session.Options.MaxAge = 86400 // 1 day expiry
-	err = session.Save(r, w)
+	if !validateWebhookRequest(w, &req) {
+		return
+	}
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logErrorf("Error generating webhook secret for user %d: %v", userID, err)
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+
+	dbMutex.Lock()
+	result, err := db.ExecContext(r.Context(),
+		"INSERT INTO webhooks (user_id, url, secret, events) VALUES (?, ?, ?, ?)",
+		userID, req.URL, req.Secret, strings.Join(req.Events, ","),
+	)
+	dbMutex.Unlock()
 	if err != nil {
-		log.Printf("Error saving session for user %d: %v", userID, err)
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		logErrorf("Error inserting webhook for user %d: %v", userID, err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
 		return
 	}
+	webhookID, _ := result.LastInsertId()
 
-	log.Printf("User logged in successfully: %s (ID: %d)", req.Username, userID)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
+	if req.Events == nil {
+		req.Events = []string{}
+	}
+	log.Printf("Created webhook %d for user %d: %s", webhookID, userID, req.URL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Webhook{ID: webhookID, URL: req.URL, Secret: req.Secret, Events: req.Events})
 }
 
-// POST /logout
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := sessionStore.Get(r, sessionKeyName)
-	// Clear session data
-	session.Values[userIDContextKey] = nil
-	session.Options.MaxAge = -1 // Expire cookie immediately
-	err := session.Save(r, w)
+// PUT /api/webhooks/{id} (Authenticated)
+// Updates the URL and events; the secret is only changed when a new one is provided
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	webhookID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		log.Printf("Error saving session during logout: %v", err)
-		http.Error(w, "Logout failed", http.StatusInternalServerError)
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
 		return
 	}
-	log.Println("User logged out")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Logout successful"})
-}
 
-// POST /pdf (Public) - Rewritten PDF Handler
-func pdfHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	defer r.Body.Close()
 
-	// 1. Read and decode the JSON request body
-	bodyBytes, err := io.ReadAll(r.Body)
+	if !validateWebhookRequest(w, &req) {
+		return
+	}
+
+	dbMutex.Lock()
+	result, err := db.ExecContext(r.Context(),
+		"UPDATE webhooks SET url = ?, events = ?, secret = CASE WHEN ? = '' THEN secret ELSE ? END WHERE id = ? AND user_id = ?",
+		req.URL, strings.Join(req.Events, ","), req.Secret, req.Secret, webhookID, userID,
+	)
+	dbMutex.Unlock()
 	if err != nil {
-		log.Printf("Error reading PDF request body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		logErrorf("Error updating webhook %d for user %d: %v", webhookID, userID, err)
+		http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
 		return
 	}
-	defer r.Body.Close()
 
-	var pdfReq PDFRequest
-	if err := json.Unmarshal(bodyBytes, &pdfReq); err != nil {
-		log.Printf("Error decoding PDF request JSON: %v. Body: %s", err, string(bodyBytes))
-		http.Error(w, "Invalid JSON payload: "+err.Error(), http.StatusBadRequest)
+	log.Printf("Updated webhook %d for user %d", webhookID, userID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Webhook updated successfully"})
+}
+
+// DELETE /api/webhooks/{id} (Authenticated)
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	webhookID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
 		return
 	}
 
-	if pdfReq.Input == "" {
-		log.Println("PDF request received with empty SVG input")
-		http.Error(w, "SVG input is required", http.StatusBadRequest)
+	dbMutex.Lock()
+	result, err := db.ExecContext(r.Context(), "DELETE FROM webhooks WHERE id = ? AND user_id = ?", webhookID, userID)
+	dbMutex.Unlock()
+	if err != nil {
+		logErrorf("Error deleting webhook %d for user %d: %v", webhookID, userID, err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
 		return
 	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Deleted webhook %d for user %d", webhookID, userID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Webhook deleted successfully"})
+}
+
+// --- Project Events ---
+
+// eventKeepAliveInterval is how often an idle event stream sends a comment, so proxies and
+// browsers don't close it
+const eventKeepAliveInterval = 30 * time.Second
+
+// projectEvent is one message for the subscribers of a project
+type projectEvent struct {
+	name string
+	data []byte
+}
+
+// projectEventHub fans project events out to the event streams open for each project
+type projectEventHub struct {
+	mu   sync.Mutex
+	subs map[int64]map[chan projectEvent]struct{}
+}
+
+var projectEvents = &projectEventHub{subs: make(map[int64]map[chan projectEvent]struct{})}
+
+// subscribe registers a stream for projectID; the returned function unregisters it
+func (h *projectEventHub) subscribe(projectID int64) (<-chan projectEvent, func()) {
+	ch := make(chan projectEvent, 8)
+	h.mu.Lock()
+	if h.subs[projectID] == nil {
+		h.subs[projectID] = make(map[chan projectEvent]struct{})
+	}
+	h.subs[projectID][ch] = struct{}{}
+	h.mu.Unlock()
 
-	log.Println("Received PDF generation request, creating temp directory...")
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[projectID], ch)
+		if len(h.subs[projectID]) == 0 {
+			delete(h.subs, projectID)
+		}
+		h.mu.Unlock()
+	}
+}
 
-	// 2. Create a temporary directory
-	tempDir, err := os.MkdirTemp("", pdfTempDirPrefix)
-	if err != nil {
-		log.Printf("Failed to create temporary directory: %v", err)
-		http.Error(w, "Failed to process request (temp dir)", http.StatusInternalServerError)
+// publish sends an event to every stream of projectID. A stream that has fallen behind misses
+// the event rather than blocking the publisher.
+func (h *projectEventHub) publish(projectID int64, name string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[projectID] {
+		select {
+		case ch <- projectEvent{name: name, data: data}:
+		default:
+			logWarnf("Event stream of project %d is behind, dropping %s", projectID, name)
+		}
+	}
+}
+
+// isEventStreamRequest reports whether a request opens a long-lived event stream, which must not
+// be bound by the request timeout
+func isEventStreamRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/projects/") && strings.HasSuffix(r.URL.Path, "/events")
+}
+
+// GET /api/projects/{id}/events (Authenticated)
+// Server-sent events stream with one message per change of the project, using the webhook event
+// names and payloads, plus keep-alive comments while idle
+func projectEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
 		return
 	}
-	log.Printf("Temporary directory created: %s", tempDir)
-	defer func() {
-		log.Printf("Cleaning up temporary directory: %s", tempDir)
-		if err := os.RemoveAll(tempDir); err != nil {
-			log.Printf("Error cleaning up temporary directory %s: %v", tempDir, err)
+
+	dbMutex.Lock()
+	ok = requireProjectOwner(w, projectID, userID)
+	dbMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	events, unsubscribe := projectEvents.subscribe(projectID)
+	defer unsubscribe()
+
+	// The stream stays open indefinitely; each write gets WriteTimeout so dead clients are noticed
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		logErrorf("Error clearing read deadline for event stream: %v", err)
+	}
+	send := func(message string) bool {
+		var deadline time.Time
+		if cfg.WriteTimeout > 0 {
+			deadline = time.Now().Add(cfg.WriteTimeout)
 		}
-	}()
+		rc.SetWriteDeadline(deadline)
+		if _, err := io.WriteString(w, message); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
 
-	// 3. Write the SVG input to a file in the temp directory
-	svgFilePath := filepath.Join(tempDir, "underlog.svg")
-	if err := os.WriteFile(svgFilePath, []byte(pdfReq.Input), 0644); err != nil {
-		log.Printf("Failed to write SVG to temporary file %s: %v", svgFilePath, err)
-		http.Error(w, "Failed to process request (write SVG)", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	if !send(": connected\n\n") {
 		return
 	}
-	log.Printf("SVG content written to %s", svgFilePath)
 
-	// 4. Execute the bash scripts sequentially
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if !send(": keep-alive\n\n") {
+				return
+			}
+		case event := <-events:
+			if !send(fmt.Sprintf("event: %s\ndata: %s\n\n", event.name, event.data)) {
+				return
+			}
+		}
+	}
+}
 
-	// Script 1: awk to split SVG
-	awkCmd := `awk '/<svg/{n++} n{print > "input_" n ".svg"}' underlog.svg`
-	log.Printf("Executing awk command in %s: %s", tempDir, awkCmd)
-	cmd1 := exec.Command("bash", "-c", awkCmd)
-	cmd1.Dir = tempDir
-	output1, err := cmd1.CombinedOutput()
-	if err != nil {
-		log.Printf("Error executing awk command: %v\nOutput: %s", err, string(output1))
-		http.Error(w, "Failed to process SVG (split step)", http.StatusInternalServerError)
+// --- Audit Log ---
+
+const (
+	auditActionLogin         = "login"
+	auditActionProjectRead   = "project_read"
+	auditActionProjectUpdate = "project_update"
+	auditActionImageRead     = "image_read"
+	auditActionPDFGenerate   = "pdf_generate"
+	auditQueueSize           = 1024
+	auditBatchSize           = 100
+	auditEnqueueTimeout      = 5 * time.Second // How long recordAudit waits for room in a full queue
+)
+
+// auditEntry is one queued audit_log row; zero user or target IDs are stored as NULL
+type auditEntry struct {
+	userID    int64
+	action    string
+	targetID  int64
+	ip        string
+	createdAt time.Time
+}
+
+var (
+	auditQueue       = make(chan auditEntry, auditQueueSize)
+	auditWriterDone  = make(chan struct{})
+	auditQueueMutex  sync.RWMutex // Write-locked to close auditQueue
+	auditQueueClosed bool
+	auditPending     sync.WaitGroup // recordAuditAsync calls still running
+)
+
+// recordAudit queues an audit entry. When the writer falls behind it waits up to auditEnqueueTimeout
+// for room rather than drop the entry. The writer needs dbMutex to drain the queue, so handlers
+// holding dbMutex use recordAuditAsync.
+func recordAudit(r *http.Request, userID int64, action string, targetID int64) {
+	entry := auditEntry{userID: userID, action: action, targetID: targetID, ip: clientIP(r), createdAt: time.Now().UTC()}
+	auditQueueMutex.RLock()
+	defer auditQueueMutex.RUnlock()
+	if auditQueueClosed {
+		logWarnf("Audit writer stopped, dropping %s entry for user %d", action, userID)
+		return
+	}
+	select {
+	case auditQueue <- entry:
 		return
+	default:
 	}
-	log.Printf("awk command successful.\n")
+	timer := time.NewTimer(auditEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case auditQueue <- entry:
+	case <-timer.C:
+		logErrorf("Audit queue still full after %v, dropping %s entry for user %d", auditEnqueueTimeout, action, userID)
+	}
+}
 
-	// Script 2: svg2pdf loop
-	svg2pdfCmd := `for file in input_*.svg; do svg2pdf "$file" "${file%.svg}.pdf"; done`
-	log.Printf("Executing svg2pdf loop in %s: %s", tempDir, svg2pdfCmd)
-	cmd2 := exec.Command("bash", "-c", svg2pdfCmd)
-	cmd2.Dir = tempDir
-	output2, err := cmd2.CombinedOutput()
+// recordAuditAsync calls recordAudit in a goroutine that stopAuditWriter waits for
+func recordAuditAsync(r *http.Request, userID int64, action string, targetID int64) {
+	auditPending.Add(1)
+	go func() {
+		defer auditPending.Done()
+		recordAudit(r, userID, action, targetID)
+	}()
+}
+
+// runAuditWriter drains the audit queue, inserting whatever has accumulated in a single transaction
+func runAuditWriter() {
+	defer close(auditWriterDone)
+	for entry := range auditQueue {
+		batch := []auditEntry{entry}
+	drain:
+		for len(batch) < auditBatchSize {
+			select {
+			case next := <-auditQueue:
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		if err := writeAuditBatch(batch); err != nil {
+			logErrorf("Error writing %d audit entries: %v", len(batch), err)
+		}
+	}
+}
+
+// stopAuditWriter closes the audit queue and waits until the entries still in it are written
+func stopAuditWriter() {
+	auditPending.Wait()
+	auditQueueMutex.Lock()
+	if !auditQueueClosed {
+		auditQueueClosed = true
+		close(auditQueue)
+	}
+	auditQueueMutex.Unlock()
+	<-auditWriterDone
+}
+
+func writeAuditBatch(batch []auditEntry) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Error executing svg2pdf loop: %v\nOutput: %s", err, string(output2))
-		http.Error(w, "Failed to process SVG (conversion step)", http.StatusInternalServerError)
-		return
+		return err
+	}
+	for _, entry := range batch {
+		_, err = tx.Exec(
+			"INSERT INTO audit_log (user_id, action, target_id, ip, created_at) VALUES (?, ?, ?, ?, ?)",
+			sql.NullInt64{Int64: entry.userID, Valid: entry.userID != 0}, entry.action,
+			sql.NullInt64{Int64: entry.targetID, Valid: entry.targetID != 0}, entry.ip, entry.createdAt,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
-	log.Printf("svg2pdf loop successful.\n")
+	return tx.Commit()
+}
 
-	// Script 3: gs to combine PDFs
-	gsCmd := `gs -sDEVICE=pdfwrite -dCompatibilityLevel=1.5 -dPDFSETTINGS=/default -dNOPAUSE -dQUIET -dBATCH -dDetectDuplicateImages -dCompressFonts=true -r150 -sOutputFile=underlog.pdf $(printf '%s\n' input_*.pdf | sort -V | tr '\n' ' ')`
-	log.Printf("Executing gs command in %s: %s", tempDir, gsCmd)
-	cmd3 := exec.Command("bash", "-c", gsCmd)
-	cmd3.Dir = tempDir
-	output3, err := cmd3.CombinedOutput()
+// sessionUserID returns the logged-in user for public routes, or 0 when there is no valid session
+func sessionUserID(r *http.Request) int64 {
+	session, err := sessionStore.Get(r, sessionKeyName)
 	if err != nil {
-		log.Printf("Error executing gs command: %v\nOutput: %s", err, string(output3))
-		http.Error(w, "Failed to process SVG (combine step)", http.StatusInternalServerError)
+		return 0
+	}
+	userID, _ := session.Values[userIDContextKey].(int64)
+	return userID
+}
+
+// AuditLogEntry is one row returned by the admin audit endpoint
+type AuditLogEntry struct {
+	ID        int64     `json:"id"`
+	UserID    *int64    `json:"user_id"`
+	Action    string    `json:"action"`
+	TargetID  *int64    `json:"target_id"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// adminMiddleware restricts a route to the usernames listed in UNDERLOG_ADMIN_USERS.
+// It must run after authMiddleware.
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(userIDContextKey).(int64)
+
+		var username string
+		dbMutex.Lock()
+		err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+		dbMutex.Unlock()
+		if err != nil && err != sql.ErrNoRows {
+			logErrorf("Admin middleware: Error looking up user %d: %v", userID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err != nil || !isAdminUsername(username) {
+			logWarnf("Admin middleware: User %d denied access to %s", userID, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdminUsername reports whether username is listed in UNDERLOG_ADMIN_USERS (usernames are case-insensitive)
+func isAdminUsername(username string) bool {
+	for _, admin := range cfg.AdminUsers {
+		if strings.EqualFold(admin, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /api/admin/audit?user_id=&since=&limit=&offset= (Admin)
+// Returns audit entries newest first; since is an RFC 3339 timestamp
+func getAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if value := query.Get("user_id"); value != "" {
+		filterUserID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "user_id = ?")
+		args = append(args, filterUserID)
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid since, expected RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "created_at >= ?")
+		args = append(args, since.UTC())
+	}
+	limit, offset, ok := paginationParams(w, r, 100, 1000)
+	if !ok {
 		return
 	}
-	log.Printf("gs command successful.\n")
+	args = append(args, limit, offset)
 
-	// 5. Read the resulting underlog.pdf
-	pdfFilePath := filepath.Join(tempDir, "underlog.pdf")
-	pdfBytes, err := os.ReadFile(pdfFilePath)
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	rows, err := db.Query(
+		"SELECT id, user_id, action, target_id, ip, created_at FROM audit_log WHERE "+strings.Join(where, " AND ")+
+			" ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?",
+		args...,
+	)
 	if err != nil {
-		log.Printf("Failed to read generated PDF file %s: %v", pdfFilePath, err)
-		http.Error(w, "Failed to retrieve generated PDF", http.StatusInternalServerError)
+		logErrorf("Error querying audit log: %v", err)
+		http.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Successfully generated and read %s (%d bytes)", pdfFilePath, len(pdfBytes))
+	defer rows.Close()
 
-	// 6. Send the PDF to the client
-	w.Header().Set("Content-Type", "application/pdf")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", "underlog.pdf"))
-	w.Header().Set("Content-Length", strconv.Itoa(len(pdfBytes)))
-	w.WriteHeader(http.StatusOK) // Or http.StatusCreated if you prefer
-	_, err = w.Write(pdfBytes)
-	if err != nil {
-		log.Printf("Error writing PDF response to client: %v", err)
-		// Client connection might have closed, not much to do here
+	entries := []AuditLogEntry{}
+	for rows.Next() {
+		var entry AuditLogEntry
+		var entryUserID, targetID sql.NullInt64
+		if err := rows.Scan(&entry.ID, &entryUserID, &entry.Action, &targetID, &entry.IP, &entry.CreatedAt); err != nil {
+			logErrorf("Error scanning audit log row: %v", err)
+			http.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+			return
+		}
+		if entryUserID.Valid {
+			entry.UserID = &entryUserID.Int64
+		}
+		if targetID.Valid {
+			entry.TargetID = &targetID.Int64
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		logErrorf("Error iterating audit log rows: %v", err)
+		http.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
 }
 
-// POST /odt (Public)
-func odtHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement actual ODT generation logic
-	log.Println("ODT endpoint called (not implemented)")
-	http.Error(w, "ODT generation not implemented", http.StatusNotImplemented)
+// --- Embedding ---
+
+// Embed tokens let an owner show a read-only rendering of a project inside an iframe on one other
+// origin. A token is base64url(JSON claims) + "." + base64url(HMAC-SHA256 of the claims), so the
+// server can check it without storing anything.
+
+const (
+	defaultEmbedTokenTTL = 7 * 24 * time.Hour
+	maxEmbedTokenTTL     = 30 * 24 * time.Hour
+)
+
+type EmbedTokenRequest struct {
+	Origin    string `json:"origin"`     // The only origin allowed to frame the embed, e.g. https://blog.example.com
+	ExpiresIn int64  `json:"expires_in"` // Seconds until the token expires; 0 uses the default
 }
 
-// GET /api/projects (Authenticated)
-func getProjectsHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(userIDContextKey).(int64)
+type EmbedTokenResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
 
-	dbMutex.Lock()
-	rows, err := db.Query("SELECT id, name FROM projects WHERE user_id = ? ORDER BY updated_at DESC", userID)
-	dbMutex.Unlock()
+// embedClaims is the signed content of an embed token
+type embedClaims struct {
+	ProjectID int64  `json:"p"`
+	UserID    int64  `json:"u"`
+	Origin    string `json:"o"`
+	ExpiresAt int64  `json:"e"` // Unix seconds
+}
+
+// embedTokenKey derives a signing key from a session secret, so the two never share a MAC key
+func embedTokenKey(secret string) []byte {
+	sum := sha256.Sum256([]byte("underlog-embed-token:" + secret))
+	return sum[:]
+}
+
+func signEmbedToken(claims embedClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, embedTokenKey(cfg.SessionSecrets[0]))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
 
+// verifyEmbedToken checks the signature and expiry of a token and returns its claims
+func verifyEmbedToken(token string) (embedClaims, error) {
+	var claims embedClaims
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
 	if err != nil {
-		log.Printf("Error querying projects for user %d: %v", userID, err)
-		http.Error(w, "Failed to retrieve projects", http.StatusInternalServerError)
-		return
+		return claims, errors.New("malformed token")
 	}
-	defer rows.Close()
-
-	projects := []ProjectListItem{}
-	for rows.Next() {
-		var p ProjectListItem
-		if err := rows.Scan(&p.ID, &p.Name); err != nil {
-			log.Printf("Error scanning project row for user %d: %v", userID, err)
-			http.Error(w, "Failed to process projects", http.StatusInternalServerError)
-			return
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+	// Tokens signed before a session secret rotation stay valid while the old secret is listed
+	valid := false
+	for _, secret := range cfg.SessionSecrets {
+		mac := hmac.New(sha256.New, embedTokenKey(secret))
+		mac.Write(payload)
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			valid = true
+			break
 		}
-		projects = append(projects, p)
 	}
-
-	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating project rows for user %d: %v", userID, err)
-		http.Error(w, "Failed to retrieve projects", http.StatusInternalServerError)
-		return
+	if !valid {
+		return claims, errors.New("invalid signature")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed token")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token expired")
 	}
+	return claims, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(projects)
+// normalizeOrigin reduces an http(s) origin to scheme://host[:port], rejecting paths and queries
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("origin must be an absolute http(s) origin such as https://example.com")
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", errors.New("origin must not contain a path, query, fragment or credentials")
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
 }
 
-// POST /api/projects (Authenticated)
-func createProjectHandler(w http.ResponseWriter, r *http.Request) {
+// POST /api/projects/{id}/embed (Authenticated)
+// Mints a signed, time-limited token for embedding the project read-only on one origin
+func createEmbedTokenHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(userIDContextKey).(int64)
+	projectID, ok := projectIDFromRequest(w, r)
+	if !ok {
+		return
+	}
 
-	var req CreateProjectRequest
+	var req EmbedTokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
-	projectName := req.Name
-	if projectName == "" {
-		projectName = defaultProjectName // Or require a name from the client
-	}
-
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	// Check if project name already exists for this user
-	var existingID int64
-	err := db.QueryRow("SELECT id FROM projects WHERE user_id = ? AND name = ?", userID, projectName).Scan(&existingID)
-	if err == nil {
-		http.Error(w, "Project name already exists", http.StatusConflict)
-		return
+	var validation ValidationErrors
+	origin, err := normalizeOrigin(req.Origin)
+	validation.check("origin", err)
+	ttl := defaultEmbedTokenTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+		if ttl <= 0 || ttl > maxEmbedTokenTTL {
+			validation.add("expires_in", fmt.Sprintf("must be between 1 and %d seconds", int64(maxEmbedTokenTTL.Seconds())))
+		}
 	}
-	if err != sql.ErrNoRows {
-		log.Printf("Error checking for existing project '%s' for user %d: %v", projectName, userID, err)
-		http.Error(w, "Failed to create project", http.StatusInternalServerError)
+	if validation.respond(w) {
 		return
 	}
 
-	result, err := db.Exec(
-		"INSERT INTO projects (user_id, name, body, updated_at) VALUES (?, ?, ?, ?)",
-		userID, projectName, req.Body, time.Now(),
-	)
-	if err != nil {
-		log.Printf("Error inserting new project '%s' for user %d: %v", projectName, userID, err)
-		http.Error(w, "Failed to create project", http.StatusInternalServerError)
+	dbMutex.Lock()
+	ok = requireProjectOwner(w, projectID, userID)
+	dbMutex.Unlock()
+	if !ok {
 		return
 	}
 
-	projectID, err := result.LastInsertId()
+	expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	token, err := signEmbedToken(embedClaims{ProjectID: projectID, UserID: userID, Origin: origin, ExpiresAt: expiresAt.Unix()})
 	if err != nil {
-		log.Printf("Error getting last insert ID for project '%s', user %d: %v", projectName, userID, err)
-		// Project was created, but we can't return the ID easily. Log and maybe return 201 without ID.
-		http.Error(w, "Project created but failed to retrieve ID", http.StatusInternalServerError)
+		logErrorf("Error signing embed token for project %d: %v", projectID, err)
+		http.Error(w, "Failed to create embed token", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Created project ID %d ('%s') for user %d", projectID, projectName, userID)
+	log.Printf("Created embed token for project %d of user %d, origin %s, expiring %s", projectID, userID, origin, expiresAt.Format(time.RFC3339))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":   "Project created successfully",
-		"projectId": projectID,
-		"name":      projectName,
-	})
+	json.NewEncoder(w).Encode(EmbedTokenResponse{Token: token, URL: cfg.BasePath + "/embed/" + token, ExpiresAt: expiresAt})
 }
 
-// GET /api/projects/{id} (Authenticated)
-func getProjectHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(userIDContextKey).(int64)
-	vars := mux.Vars(r)
-	projectIDStr := vars["id"]
-	projectID, err := strconv.ParseInt(projectIDStr, 10, 64)
+// embedPageTemplate renders the body with the web client's own tokenizer and SVG modules (see static/embed.js)
+var embedPageTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>body { margin: 0; } #result svg { display: block; margin: 0 auto 1em; max-width: 100%; height: auto; }</style>
+</head>
+<body>
+<div id="result"></div>
+<script id="underlog-body" type="application/json">{{.Body}}</script>
+<script type="module" src="{{.BasePath}}/embed.js"></script>
+</body>
+</html>
+`))
+
+// GET /embed/{token} (Public)
+// Serves a read-only rendering of the project, frameable only by the origin pinned in the token
+func embedHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := verifyEmbedToken(mux.Vars(r)["token"])
 	if err != nil {
-		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		http.Error(w, "Invalid embed token: "+err.Error(), http.StatusForbidden)
 		return
 	}
 
-	log.Printf("Fetching project %d for user %d", projectID, userID)
-
-	var project ProjectDetail
-	project.ID = projectID
-
+	var name, body string
 	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	// Fetch project name and body
-	err = db.QueryRow("SELECT name, body FROM projects WHERE id = ? AND user_id = ?", projectID, userID).Scan(&project.Name, &project.Body)
+	// Checking the owner too means a token stops working if the project changes hands or is deleted
+	err = db.QueryRow("SELECT name, body FROM projects WHERE id = ? AND user_id = ?", claims.ProjectID, claims.UserID).Scan(&name, (*storedBody)(&body))
+	dbMutex.Unlock()
 	if err != nil {
 		if err == sql.ErrNoRows {
-			log.Printf("Project %d not found or does not belong to user %d", projectID, userID)
 			http.Error(w, "Project not found", http.StatusNotFound)
 		} else {
-			log.Printf("Error fetching project %d details for user %d: %v", projectID, userID, err)
+			logErrorf("Error fetching project %d for embed: %v", claims.ProjectID, err)
 			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
 		}
 		return
 	}
 
-	// Fetch image names for the project
-	rows, err := db.Query("SELECT name FROM images WHERE project_id = ?", projectID)
-	if err != nil {
-		log.Printf("Error fetching image names for project %d: %v", projectID, err)
-		http.Error(w, "Failed to retrieve project images", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	imageNames := []string{}
-	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			log.Printf("Error scanning image name for project %d: %v", projectID, err)
-			// Continue trying to fetch other names
-		} else {
-			imageNames = append(imageNames, name)
-		}
+	// X-Frame-Options cannot name an allowed origin, so framing is restricted by frame-ancestors alone
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf(
+		"default-src 'none'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; font-src 'self'; connect-src 'self'; frame-ancestors %s",
+		claims.Origin,
+	))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := embedPageTemplate.Execute(w, struct{ Name, Body, BasePath string }{name, body, cfg.BasePath}); err != nil {
+		logErrorf("Error rendering embed page for project %d: %v", claims.ProjectID, err)
 	}
-	project.ImageNames = imageNames
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(project)
 }
 
-// GET /api/projects/{id}/image/{image_name} (Authenticated)
-func getProjectImageHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(userIDContextKey).(int64)
-	vars := mux.Vars(r)
-	projectIDStr := vars["id"]
-	imageName := vars["image_name"]
+// --- Static Files ---
 
-	projectID, err := strconv.ParseInt(projectIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid project ID", http.StatusBadRequest)
-		return
+// checkStaticDir verifies the static directory and index.html exist, logging a warning
+// (or exiting when UNDERLOG_REQUIRE_STATIC is set) and returning false if they do not
+func checkStaticDir() bool {
+	problem := ""
+	if info, err := os.Stat(cfg.StaticDir); err != nil || !info.IsDir() {
+		problem = fmt.Sprintf("static directory %s not found", cfg.StaticDir)
+	} else if _, err := os.Stat(filepath.Join(cfg.StaticDir, "index.html")); err != nil {
+		problem = fmt.Sprintf("%s not found", filepath.Join(cfg.StaticDir, "index.html"))
+	}
+	if problem == "" {
+		return true
+	}
+	if cfg.RequireStatic {
+		logFatalf("Static files unavailable: %s (run from the repository root or unset UNDERLOG_REQUIRE_STATIC)", problem)
 	}
+	logWarnf("Static files unavailable: %s; serving the API only, with a JSON landing response at /", problem)
+	return false
+}
 
-	log.Printf("Fetching image '%s' for project %d, user %d", imageName, projectID, userID)
+// APILanding is served at / when the web client is not installed
+type APILanding struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version"`
+	Endpoints []string `json:"endpoints"`
+}
 
-	var blob []byte
-	var ownerUserID int64
+// landingEndpoints are the entry points listed by the API landing response
+var landingEndpoints = []string{
+	"POST /register",
+	"POST /login",
+	"POST /logout",
+	"GET /api/projects",
+	"GET /api/projects/{id}",
+	"POST /pdf",
+	"GET /healthz/pdf",
+}
 
-	dbMutex.Lock()
-	// Verify the project belongs to the user before fetching the blob
-	err = db.QueryRow("SELECT user_id FROM projects WHERE id = ?", projectID).Scan(&ownerUserID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Project not found", http.StatusNotFound)
-		} else {
-			log.Printf("Error checking project owner for image request (project %d, user %d): %v", projectID, userID, err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
-		dbMutex.Unlock()
-		return
+// GET / (Public, API-only deployments)
+// Describes the API instead of answering the document root with a 404
+func landingHandler(w http.ResponseWriter, r *http.Request) {
+	landing := APILanding{Name: "underlog", Version: version, Endpoints: make([]string, len(landingEndpoints))}
+	for i, endpoint := range landingEndpoints {
+		method, path, _ := strings.Cut(endpoint, " ")
+		landing.Endpoints[i] = method + " " + cfg.BasePath + path
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(landing)
+}
 
-	if ownerUserID != userID {
-		log.Printf("User %d attempted to access image '%s' from project %d owned by user %d", userID, imageName, projectID, ownerUserID)
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		dbMutex.Unlock()
+// GET /
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	indexPath := filepath.Join(cfg.StaticDir, "index.html")
+	if _, err := os.Stat(indexPath); err != nil {
+		logErrorf("Cannot serve %s: %v", indexPath, err)
+		http.Error(w, fmt.Sprintf("The underlog web client is not installed: %s is missing on the server. The API is still available.", indexPath), http.StatusServiceUnavailable)
 		return
 	}
+	http.ServeFile(w, r, indexPath)
+}
 
-	// Fetch the image blob
-	err = db.QueryRow("SELECT blob FROM images WHERE project_id = ? AND name = ?", projectID, imageName).Scan(&blob)
-	dbMutex.Unlock() // Unlock before writing response
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("Image '%s' not found for project %d", imageName, projectID)
-			http.Error(w, "Image not found", http.StatusNotFound)
-		} else {
-			log.Printf("Error fetching image blob '%s' for project %d: %v", imageName, projectID, err)
-			http.Error(w, "Failed to retrieve image", http.StatusInternalServerError)
+// staticHandler serves the static directory. With UNDERLOG_SPA_FALLBACK, a GET for a path that
+// matches no file, has no file extension and is outside /api is answered with index.html so the
+// client-side router can resolve it; missing assets like /app.js still get a 404.
+func staticHandler() http.Handler {
+	fileServer := http.StripPrefix("/", http.FileServer(http.Dir(cfg.StaticDir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.SPAFallback && isClientRoute(r) {
+			f, err := http.Dir(cfg.StaticDir).Open(r.URL.Path)
+			if err == nil {
+				f.Close()
+			} else if errors.Is(err, os.ErrNotExist) {
+				indexHandler(w, r)
+				return
+			}
 		}
-		return
-	}
-
-	// Determine content type (simple check based on extension)
-	contentType := "application/octet-stream" // Default
-	ext := filepath.Ext(imageName)
-	switch ext {
-	case ".png":
-		contentType = "image/png"
-	case ".jpg", ".jpeg":
-		contentType = "image/jpeg"
-	case ".gif":
-		contentType = "image/gif"
-	case ".svg":
-		contentType = "image/svg+xml"
-	case ".webp":
-		contentType = "image/webp"
-	}
-
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
-	w.WriteHeader(http.StatusOK)
-	w.Write(blob)
+		fileServer.ServeHTTP(w, r)
+	})
 }
 
-// PUT /api/projects/{id} (Authenticated) - Sync Endpoint
-func updateProjectHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(userIDContextKey).(int64)
-	vars := mux.Vars(r)
-	projectIDStr := vars["id"]
-	projectID, err := strconv.ParseInt(projectIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid project ID", http.StatusBadRequest)
-		return
+// isClientRoute reports whether a request could be a client-side route rather than an asset or API call
+func isClientRoute(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
 	}
-
-	var req UpdateProjectRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	if r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/") {
+		return false
 	}
-	defer r.Body.Close()
+	return filepath.Ext(r.URL.Path) == ""
+}
 
-	log.Printf("Updating project %d ('%s') for user %d", projectID, req.Name, userID)
+// --- Server ---
 
-	dbMutex.Lock() // Lock for the duration of the transaction
-	tx, err := db.Begin()
-	if err != nil {
-		dbMutex.Unlock()
-		log.Printf("Error starting transaction for project %d update: %v", projectID, err)
-		http.Error(w, "Failed to update project", http.StatusInternalServerError)
-		return
+// mountAtBasePath serves next under cfg.BasePath, stripping the prefix so routes stay registered
+// at the root. The bare prefix redirects to prefix/ so relative URLs in the web client resolve
+// below it; paths outside the prefix get a 404.
+func mountAtBasePath(next http.Handler) http.Handler {
+	if cfg.BasePath == "" {
+		return next
 	}
-	// Ensure rollback on error, then unlock
-	defer func() {
-		if p := recover(); p != nil {
-			tx.Rollback() // Rollback on panic
-			dbMutex.Unlock()
-			panic(p) // Re-throw panic
-		} else if err != nil {
-			tx.Rollback() // Rollback on error
-			dbMutex.Unlock()
-		} else {
-			err = tx.Commit() // Commit on success
-			dbMutex.Unlock()
-			if err != nil {
-				log.Printf("Error committing transaction for project %d update: %v", projectID, err)
-				// Respond with error after unlock attempt
-				// Note: This error response might not reach the client if unlock fails critically
-				// but we try to send it anyway.
-				http.Error(w, "Failed to save changes", http.StatusInternalServerError)
-			} else {
-				log.Printf("Successfully updated project %d", projectID)
-				w.WriteHeader(http.StatusOK)
-				json.NewEncoder(w).Encode(map[string]string{"message": "Project updated successfully"})
+	stripped := http.StripPrefix(cfg.BasePath, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == cfg.BasePath:
+			target := cfg.BasePath + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
 			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, cfg.BasePath+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
 		}
-	}()
+	})
+}
 
-	// 1. Verify project ownership and update project details
-	projectName := req.Name
-	if projectName == "" {
-		projectName = defaultProjectName // Or handle error
-	}
+// tlsEnabled reports whether the server terminates TLS itself
+func tlsEnabled() bool {
+	return cfg.Domain != "" || (cfg.TLSCertFile != "" && cfg.TLSKeyFile != "")
+}
 
-	result, err := tx.Exec(
-		"UPDATE projects SET name = ?, body = ?, updated_at = ? WHERE id = ? AND user_id = ?",
-		projectName, req.Body, time.Now(), projectID, userID,
-	)
-	if err != nil {
-		log.Printf("Error updating project %d details: %v", projectID, err)
-		return // Defer will rollback
-	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		log.Printf("Project %d not found or does not belong to user %d during update", projectID, userID)
-		err = errors.New("project not found or forbidden")                       // Set error for defer rollback
-		http.Error(w, "Project not found or access denied", http.StatusNotFound) // Respond before defer
-		return
+// newServer builds an http.Server with the configured timeouts, so slow clients cannot hold
+// connections open indefinitely
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
 	}
+}
 
-	// 2. Synchronize images: Delete removed images, Add/Update others
-	existingImages := make(map[string]bool)
-	rows, err := tx.Query("SELECT name FROM images WHERE project_id = ?", projectID)
-	if err != nil {
-		log.Printf("Error querying existing images for project %d: %v", projectID, err)
-		return // Defer will rollback
-	}
-	for rows.Next() {
-		var name string
-		if err = rows.Scan(&name); err != nil {
-			rows.Close()
-			log.Printf("Error scanning existing image name for project %d: %v", projectID, err)
-			return // Defer will rollback
-		}
-		existingImages[name] = true
+// listenAndServe starts the HTTP server: with Let's Encrypt certificates when UNDERLOG_DOMAIN
+// is set, with the given certificate files when UNDERLOG_TLS_CERT/UNDERLOG_TLS_KEY are set,
+// and as plain HTTP otherwise. On SIGINT or SIGTERM it stops accepting connections and returns
+// nil once in-flight requests have finished or UNDERLOG_SHUTDOWN_TIMEOUT has passed.
+func listenAndServe(handler http.Handler, port string) error {
+	var servers []*http.Server
+	serve := func(server *http.Server, run func() error) <-chan error {
+		servers = append(servers, server)
+		errs := make(chan error, 1)
+		go func() { errs <- run() }()
+		return errs
 	}
-	rows.Close() // Close rows before next query/exec
 
-	requestedImages := make(map[string]ProjectUpdateImage)
-	for _, img := range req.Images {
-		if img.Name != "" {
-			requestedImages[img.Name] = img
+	var errs <-chan error
+	if cfg.Domain != "" {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.Domain),
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),
 		}
-	}
 
-	// Delete images that exist in DB but not in the request
-	for name := range existingImages {
-		if _, exists := requestedImages[name]; !exists {
-			log.Printf("Deleting image '%s' from project %d", name, projectID)
-			_, err = tx.Exec("DELETE FROM images WHERE project_id = ? AND name = ?", projectID, name)
-			if err != nil {
-				log.Printf("Error deleting image '%s' from project %d: %v", name, projectID, err)
-				return // Defer will rollback
+		// Port 80 answers ACME HTTP-01 challenges and redirects everything else to HTTPS
+		log.Printf("Serving ACME challenges and HTTPS redirects on :80")
+		challenges := newServer(":80", manager.HTTPHandler(nil))
+		challengeErrs := serve(challenges, challenges.ListenAndServe)
+		go func() {
+			if err := <-challengeErrs; err != http.ErrServerClosed {
+				logErrorf("HTTP challenge listener stopped: %v", err)
 			}
-		}
+		}()
+
+		server := newServer(":443", handler)
+		server.TLSConfig = manager.TLSConfig()
+		log.Printf("Server starting on https://%s", cfg.Domain)
+		errs = serve(server, func() error { return server.ListenAndServeTLS("", "") })
+	} else if tlsEnabled() {
+		log.Printf("Server starting on https://localhost:%s", port)
+		server := newServer(":"+port, handler)
+		errs = serve(server, func() error { return server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile) })
+	} else {
+		log.Printf("Server starting on http://localhost:%s", port)
+		server := newServer(":"+port, handler)
+		errs = serve(server, server.ListenAndServe)
 	}
 
-	// Add or Update images present in the request
-	for name, imgData := range requestedImages {
-		if imgData.BlobBase64 != "" { // Only process if blob data is provided
-			blob, decodeErr := base64.StdEncoding.DecodeString(imgData.BlobBase64)
-			if decodeErr != nil {
-				log.Printf("Error decoding base64 for image '%s' in project %d: %v", name, projectID, decodeErr)
-				err = decodeErr                                                      // Set error for defer rollback
-				http.Error(w, "Invalid image data for "+name, http.StatusBadRequest) // Respond before defer
-				return
-			}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %v, waiting up to %v for in-flight requests", sig, cfg.ShutdownTimeout)
+	}
 
-			if existingImages[name] {
-				// Update existing image (if needed - could skip if blob unchanged, but upsert is easier)
-				// log.Printf("Updating image '%s' in project %d", name, projectID)
-				// _, err = tx.Exec("UPDATE images SET blob = ? WHERE project_id = ? AND name = ?", blob, projectID, name)
-				// Use INSERT OR REPLACE (Upsert)
-				log.Printf("Updating image '%s' in project %d", name, projectID)
-				_, err = tx.Exec(
-					"INSERT OR REPLACE INTO images (project_id, name, blob) VALUES (?, ?, ?)",
-					projectID, name, blob,
-				)
-			} else {
-				// Insert new image
-				log.Printf("Inserting new image '%s' into project %d", name, projectID)
-				_, err = tx.Exec(
-					"INSERT INTO images (project_id, name, blob) VALUES (?, ?, ?)",
-					projectID, name, blob,
-				)
-			}
-			if err != nil {
-				log.Printf("Error upserting image '%s' for project %d: %v", name, projectID, err)
-				return // Defer will rollback
-			}
-		} else if !existingImages[name] {
-			// Image requested without blob data, and it doesn't exist yet. This is likely an error
-			// or indicates the client expects the server to keep the old blob if name matches.
-			// For simplicity, we'll treat this as an error or ignore it. Ignoring for now.
-			log.Printf("Image '%s' requested for project %d without blob data and doesn't exist, skipping insert.", name, projectID)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logWarnf("Server on %s did not shut down cleanly: %v", server.Addr, err)
 		}
 	}
-
-	// If we reach here without error, defer will commit.
+	return nil
 }
 
 // --- Main Function ---
@@ -799,19 +8561,59 @@ func updateProjectHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	var err error
 
-	// Initialize session store
-	// TODO: Load secret from environment variable or config file for production
-	if sessionSecret == "replace-this-with-a-real-secret-key" {
-		log.Println("WARNING: Using default insecure session secret key!")
+	cfg = loadConfig()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel})))
+	projectCache = newProjectLRU(cfg.ProjectCacheSize)
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		logFatalf("UNDERLOG_TLS_CERT and UNDERLOG_TLS_KEY must be set together")
+	}
+	if err = loadBodyTemplate(); err != nil {
+		logFatalf("Failed to load default project template: %v", err)
 	}
-	sessionStore = sessions.NewCookieStore([]byte(sessionSecret))
 
 	// Initialize database
 	db, err = initDB(dbFileName)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		logFatalf("Failed to initialize database: %v", err)
+	}
+
+	// Initialize session store
+	if cfg.SessionSecrets[0] == defaultSessionSecret {
+		logWarnf("Using default insecure session secret key! Set UNDERLOG_SESSION_SECRETS")
+	}
+	if len(cfg.SessionSecrets) > 1 {
+		log.Printf("Accepting sessions signed with %d previous session secrets", len(cfg.SessionSecrets)-1)
+	}
+	if err = initBodyCipher(cfg.EncryptionKey); err != nil {
+		logFatalf("Invalid UNDERLOG_ENCRYPTION_KEY: %v", err)
+	}
+	if bodyCipher != nil {
+		log.Printf("Encrypting project bodies at rest; existing plaintext bodies are encrypted when next saved")
+	}
+	if sessionStore, err = newSessionStore(db); err != nil {
+		logFatalf("Failed to initialize session store: %v", err)
+	}
+	if slices.Contains(cfg.CORSOrigins, "*") {
+		logWarnf("UNDERLOG_CORS_ORIGINS contains *, which only allows requests without cookies; list origins explicitly for authenticated calls")
+	}
+	if cfg.SessionSameSite == http.SameSiteNoneMode && !tlsEnabled() {
+		logWarnf("UNDERLOG_SESSION_SAMESITE=none requires TLS, using Lax instead")
+	}
+
+	if err = initImageStore(db); err != nil {
+		logFatalf("Failed to initialize image storage: %v", err)
+	}
+
+	staticAvailable := checkStaticDir()
+	if missing := missingPDFTools(); len(missing) > 0 {
+		logWarnf("PDF generation will fail, missing tools in PATH: %s", strings.Join(missing, ", "))
+	}
+	startWebhookWorkers(webhookWorkers)
+	go runAuditWriter()
+	go runPDFTempCleanup()
+	if cfg.WALCheckpointEvery > 0 {
+		go runWALCheckpoints()
 	}
-	defer db.Close() // Ensure DB is closed when main exits
 
 	// Set up router
 	r := mux.NewRouter()
@@ -820,35 +8622,99 @@ func main() {
 	r.HandleFunc("/register", registerHandler).Methods("POST")
 	r.HandleFunc("/login", loginHandler).Methods("POST")
 	r.HandleFunc("/logout", logoutHandler).Methods("POST")
-	r.HandleFunc("/pdf", pdfHandler).Methods("POST")
-	r.HandleFunc("/odt", odtHandler).Methods("POST")
+	// Generating documents is expensive, so these public routes get their own rate and size limits
+	var pdfLimiter *rateLimiter
+	if cfg.PDFRateLimit > 0 {
+		pdfLimiter = newRateLimiter(cfg.PDFRateLimit, time.Minute)
+	}
+	// Writes and renders are also limited per user, whatever IPs they come from
+	var userWriteLimiter, userPDFLimiter *rateLimiter
+	if cfg.UserWriteLimit > 0 {
+		userWriteLimiter = newRateLimiter(cfg.UserWriteLimit, time.Minute)
+	}
+	if cfg.UserPDFLimit > 0 {
+		userPDFLimiter = newRateLimiter(cfg.UserPDFLimit, time.Minute)
+	}
+	r.HandleFunc("/pdf", rateLimitByIP(pdfLimiter, rateLimitBySession(userPDFLimiter, limitRequestBody(cfg.PDFMaxInputBytes, pdfHandler)))).Methods("POST")
+	r.HandleFunc("/pdf/validate", rateLimitByIP(pdfLimiter, limitRequestBody(cfg.PDFMaxInputBytes, validatePDFHandler))).Methods("POST")
+	r.HandleFunc("/healthz/pdf", pdfHealthHandler).Methods("GET")
+	r.HandleFunc("/pdf/{hash}", getCachedPDFHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/odt", rateLimitByIP(pdfLimiter, rateLimitBySession(userPDFLimiter, limitRequestBody(cfg.PDFMaxInputBytes, odtHandler)))).Methods("POST")
+	r.HandleFunc("/embed/{token}", embedHandler).Methods("GET")
 
 	// --- Authenticated API Routes ---
 	apiRouter := r.PathPrefix("/api").Subrouter()
 	apiRouter.Use(authMiddleware) // Apply auth middleware to all /api routes
+	projectPDFLimited := rateLimitByIP(pdfLimiter, rateLimitByUser(userPDFLimiter, projectPDFHandler))
+
+	apiRouter.HandleFunc("/projects", getProjectsHandler).Methods("GET")                                                                                     // List user's projects
+	apiRouter.HandleFunc("/projects", rateLimitByUser(userWriteLimiter, createProjectHandler)).Methods("POST")                                               // Create a new project
+	apiRouter.HandleFunc("/projects/batch", batchProjectsHandler).Methods("POST")                                                                            // Get several projects at once
+	apiRouter.HandleFunc("/projects/diff", compareProjectsHandler).Methods("GET")                                                                            // Compare two projects
+	apiRouter.HandleFunc("/projects/{id}", getProjectHandler).Methods("GET")                                                                                 // Get specific project details
+	apiRouter.HandleFunc("/projects/{id}", rateLimitByUser(userWriteLimiter, updateProjectHandler)).Methods("PUT")                                           // Update/Sync specific project
+	apiRouter.HandleFunc("/projects/{id}", deleteProjectHandler).Methods("DELETE")                                                                           // Delete a project and its images
+	apiRouter.HandleFunc("/projects/{id}/body", getProjectBodyHandler).Methods("GET")                                                                        // Project body as plain text
+	apiRouter.HandleFunc("/projects/{id}/pdf", projectPDFLimited).Methods("POST")                                                                            // Render the stored project to PDF
+	apiRouter.HandleFunc("/projects/{id}/stats", getProjectStatsHandler).Methods("GET")                                                                      // Sizes and page count
+	apiRouter.HandleFunc("/projects/{id}/pages", getProjectPagesHandler).Methods("GET")                                                                      // XML-aware page count of an SVG body
+	apiRouter.HandleFunc("/projects/{id}/events", projectEventsHandler).Methods("GET")                                                                       // Server-sent events on project changes
+	apiRouter.HandleFunc("/projects/{id}/diff", diffProjectHandler).Methods("POST")                                                                          // Diff a candidate body against the stored one
+	apiRouter.HandleFunc("/projects/{id}/validate", validateProjectHandler).Methods("POST")                                                                  // Pre-flight check before an export
+	apiRouter.HandleFunc("/projects/{id}/embed", createEmbedTokenHandler).Methods("POST")                                                                    // Mint an iframe embed token
+	apiRouter.HandleFunc("/projects/{id}/versions", getProjectVersionsHandler).Methods("GET")                                                                // List stored body versions
+	apiRouter.HandleFunc("/projects/{id}/versions/{v}/restore", rateLimitByUser(userWriteLimiter, restoreProjectVersionHandler)).Methods("POST")             // Roll the body back to a version
+	apiRouter.HandleFunc("/projects/{id}/archive", archiveProjectHandler).Methods("POST")                                                                    // Hide from the project list
+	apiRouter.HandleFunc("/projects/{id}/unarchive", unarchiveProjectHandler).Methods("POST")                                                                // Restore to the project list
+	apiRouter.HandleFunc("/projects/{id}/touch", touchProjectHandler).Methods("POST")                                                                        // Bump updated_at without editing
+	apiRouter.HandleFunc("/projects/{id}/image/{image_name}", getProjectImageHandler).Methods("GET", "HEAD")                                                 // Get specific image blob
+	apiRouter.HandleFunc("/projects/{id}/image/{image_name}", rateLimitByUser(userWriteLimiter, renameProjectImageHandler)).Methods("PATCH")                 // Rename an image
+	apiRouter.HandleFunc("/projects/{id}/image/{image_name}/convert", convertProjectImageHandler).Methods("GET")                                             // Re-encode as PNG, JPEG or GIF
+	apiRouter.HandleFunc("/projects/{id}/image/{image_name}/copy-from/{src_id}", rateLimitByUser(userWriteLimiter, copyProjectImageHandler)).Methods("POST") // Copy an image from another project
+	apiRouter.HandleFunc("/projects/{id}/images.zip", getProjectImagesZipHandler).Methods("GET")                                                             // All images as a zip
+	apiRouter.HandleFunc("/projects/{id}/images/download", downloadProjectImagesHandler).Methods("POST")                                                     // Selected images as a zip
+	apiRouter.HandleFunc("/projects/{id}/contact-sheet", getContactSheetHandler).Methods("GET")                                                              // Thumbnail grid of all images as PNG
+	apiRouter.HandleFunc("/projects/{id}/images", getProjectImagesHandler).Methods("GET")                                                                    // Page through image metadata
+	apiRouter.HandleFunc("/projects/{id}/images/duplicates", getDuplicateImagesHandler).Methods("GET")                                                       // Report identical images
+	apiRouter.HandleFunc("/projects/{id}/images/duplicates/merge", rateLimitByUser(userWriteLimiter, mergeDuplicateImagesHandler)).Methods("POST")           // Keep one of each identical set
+	apiRouter.HandleFunc("/projects/{id}/images/{image_name}/upload", rateLimitByUser(userWriteLimiter, uploadImageChunkHandler)).Methods("POST")            // Upload one image chunk
+	apiRouter.HandleFunc("/projects/{id}/images/{image_name}/upload", getUploadStatusHandler).Methods("GET")                                                 // Resume info for an upload
 
-	apiRouter.HandleFunc("/projects", getProjectsHandler).Methods("GET")                             // List user's projects
-	apiRouter.HandleFunc("/projects", createProjectHandler).Methods("POST")                          // Create a new project
-	apiRouter.HandleFunc("/projects/{id}", getProjectHandler).Methods("GET")                         // Get specific project details
-	apiRouter.HandleFunc("/projects/{id}", updateProjectHandler).Methods("PUT")                      // Update/Sync specific project
-	apiRouter.HandleFunc("/projects/{id}/image/{image_name}", getProjectImageHandler).Methods("GET") // Get specific image blob
+	apiRouter.HandleFunc("/account/stats", getAccountStatsHandler).Methods("GET")                                    // Project and image totals
+	apiRouter.HandleFunc("/account/export", exportAccountHandler).Methods("GET")                                     // All projects as one zip
+	apiRouter.HandleFunc("/account/import", rateLimitByUser(userWriteLimiter, importAccountHandler)).Methods("POST") // Restore projects from an export zip
+
+	adminRouter := apiRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(adminMiddleware)                                             // Admin routes additionally require UNDERLOG_ADMIN_USERS membership
+	adminRouter.HandleFunc("/audit", getAuditLogHandler).Methods("GET")          // Query the access audit log
+	adminRouter.HandleFunc("/cache", getProjectCacheStatsHandler).Methods("GET") // Project cache hit/miss metrics
+	adminRouter.HandleFunc("/vacuum", vacuumHandler).Methods("POST")             // Reclaim space after deletions
+
+	apiRouter.HandleFunc("/webhooks", getWebhooksHandler).Methods("GET")           // List user's webhooks
+	apiRouter.HandleFunc("/webhooks", createWebhookHandler).Methods("POST")        // Register a webhook
+	apiRouter.HandleFunc("/webhooks/{id}", updateWebhookHandler).Methods("PUT")    // Update a webhook
+	apiRouter.HandleFunc("/webhooks/{id}", deleteWebhookHandler).Methods("DELETE") // Remove a webhook
+
+	// OPTIONS /{any} - catch-all so every route, including those with path variables, answers OPTIONS
+	r.PathPrefix("/").Methods("OPTIONS").HandlerFunc(optionsHandler)
 
 	// --- Static File Serving ---
-	// Serve index.html at the root
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filepath.Join(staticDir, "index.html"))
-	}).Methods("GET")
+	if staticAvailable {
+		// Serve index.html at the root
+		r.HandleFunc("/", indexHandler).Methods("GET")
 
-	// Serve other static files (js, css, etc.)
-	fs := http.FileServer(http.Dir(staticDir))
-	// Use PathPrefix and StripPrefix to serve files correctly
-	r.PathPrefix("/").Handler(http.StripPrefix("/", fs))
+		// Serve other static files (js, css, etc.), falling back to index.html for client-side routes
+		r.PathPrefix("/").Handler(staticHandler())
+	} else {
+		r.HandleFunc("/", landingHandler).Methods("GET")
+	}
 
 	// Start server
 	port := "6969"
-	log.Printf("Server starting on http://localhost:%s", port)
-	err = http.ListenAndServe(":"+port, r) // Use the mux router
+	// Use the mux router; client IP resolution wraps request logging so log lines see the real IP
+	err = listenAndServe(clientIPMiddleware(requestLogMiddleware(mountAtBasePath(corsMiddleware(timeoutMiddleware(r))))), port)
 	if err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+		logFatalf("Server failed to start: %v", err)
 	}
+	closeDB()
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSVGRootPages(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		pages   int
+		wantErr bool
+	}{
+		{"single page", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, 1, false},
+		{"pages on one line", `<svg></svg><svg></svg>`, 2, false},
+		{"pages on separate lines", "<svg>\n</svg>\n<svg>\n</svg>\n<svg/>\n", 3, false},
+		{"nested svg is not a page", `<svg><g><svg></svg></g></svg>`, 1, false},
+		{"svg in text is not a page", `<svg><text>&lt;svg&gt;</text></svg>`, 1, false},
+		{"element named like svg", `<svgfoo></svgfoo>`, 0, true},
+		{"other root", `<html></html>`, 0, true},
+		{"text between pages", `<svg></svg> page <svg></svg>`, 0, true},
+		{"unclosed", `<svg>`, 0, true},
+		{"empty", ``, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages, err := svgRootPages(tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("svgRootPages error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && pages != tt.pages {
+				t.Errorf("svgRootPages = %d, want %d", pages, tt.pages)
+			}
+			// validateSVGInput must agree, since it reports the page count /pdf sends
+			validated, err := validateSVGInput(tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateSVGInput error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && validated != pages {
+				t.Errorf("validateSVGInput = %d pages, svgRootPages = %d", validated, pages)
+			}
+		})
+	}
+}
+
+func TestValidateSVGInputRejectsActiveContent(t *testing.T) {
+	inputs := []string{
+		`<svg><script>alert(1)</script></svg>`,
+		`<svg onload="alert(1)"></svg>`,
+		`<svg><rect ONCLICK="alert(1)"/></svg>`,
+		`<svg><a href="javascript:alert(1)"><text>x</text></a></svg>`,
+		`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><a xlink:href=" Java&#9;Script:alert(1)"/></svg>`,
+		`<!DOCTYPE svg [<!ENTITY x "y">]><svg></svg>`,
+	}
+	for _, input := range inputs {
+		if _, err := validateSVGInput(input); err == nil {
+			t.Errorf("validateSVGInput(%q) accepted active content", input)
+		}
+	}
+	if _, err := validateSVGInput(`<svg><a href="https://example.com/"><rect opacity="0.5"/></a></svg>`); err != nil {
+		t.Errorf("validateSVGInput rejected a plain link: %v", err)
+	}
+}
+
+func TestApplyBodyPatch(t *testing.T) {
+	database, err := initDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	defer database.Close()
+	db = database
+	const base = "hello world"
+	result, err := db.Exec("INSERT INTO users (username, password_hash) VALUES ('patcher', 'x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := result.LastInsertId()
+	if result, err = db.Exec("INSERT INTO projects (user_id, name, body) VALUES (?, 'p', ?)", userID, base); err != nil {
+		t.Fatal(err)
+	}
+	projectID, _ := result.LastInsertId()
+	baseHash := contentHash([]byte(base))
+
+	tests := []struct {
+		name      string
+		projectID int64
+		patch     BodyPatch
+		status    int // 0 when the patch applies
+		want      string
+	}{
+		{"no ops", projectID, BodyPatch{baseHash, nil}, 0, base},
+		{"replace", projectID, BodyPatch{baseHash, []BodyPatchOp{{6, 5, "there"}}}, 0, "hello there"},
+		{"several ops", projectID, BodyPatch{baseHash, []BodyPatchOp{{0, 1, "J"}, {5, 0, ","}, {11, 0, "!"}}}, 0, "Jello, world!"},
+		{"adjacent ops", projectID, BodyPatch{baseHash, []BodyPatchOp{{0, 5, "bye"}, {5, 1, "-"}}}, 0, "bye-world"},
+		{"upper case hash", projectID, BodyPatch{strings.ToUpper(baseHash), []BodyPatchOp{{11, 0, "."}}}, 0, "hello world."},
+		{"stale base hash", projectID, BodyPatch{contentHash([]byte("hello")), []BodyPatchOp{{0, 0, "x"}}}, http.StatusConflict, ""},
+		{"empty base hash", projectID, BodyPatch{"", nil}, http.StatusConflict, ""},
+		{"offset past end", projectID, BodyPatch{baseHash, []BodyPatchOp{{12, 0, "x"}}}, http.StatusBadRequest, ""},
+		{"negative offset", projectID, BodyPatch{baseHash, []BodyPatchOp{{-1, 0, "x"}}}, http.StatusBadRequest, ""},
+		{"negative delete", projectID, BodyPatch{baseHash, []BodyPatchOp{{0, -1, "x"}}}, http.StatusBadRequest, ""},
+		{"delete past end", projectID, BodyPatch{baseHash, []BodyPatchOp{{6, 6, ""}}}, http.StatusBadRequest, ""},
+		{"delete overflows", projectID, BodyPatch{baseHash, []BodyPatchOp{{1, math.MaxInt, ""}}}, http.StatusBadRequest, ""},
+		{"overlapping ops", projectID, BodyPatch{baseHash, []BodyPatchOp{{0, 5, ""}, {4, 1, ""}}}, http.StatusBadRequest, ""},
+		{"unsorted ops", projectID, BodyPatch{baseHash, []BodyPatchOp{{6, 0, "a"}, {0, 0, "b"}}}, http.StatusBadRequest, ""},
+		{"missing project", projectID + 1, BodyPatch{baseHash, nil}, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			body, ok := applyBodyPatch(rec, tt.projectID, userID, &tt.patch)
+			if tt.status == 0 {
+				if !ok {
+					t.Fatalf("applyBodyPatch failed with %d: %s", rec.Code, rec.Body)
+				}
+				if body != tt.want {
+					t.Errorf("applyBodyPatch = %q, want %q", body, tt.want)
+				}
+				return
+			}
+			if ok {
+				t.Fatalf("applyBodyPatch = %q, want status %d", body, tt.status)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("applyBodyPatch status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header            string
+		start, end, total int64
+		wantErr           bool
+	}{
+		{"bytes 0-9/10", 0, 9, 10, false},
+		{"bytes 5-5/6", 5, 5, 6, false},
+		{"bytes 100-199/1000", 100, 199, 1000, false},
+		{"bytes 0-10/10", 0, 0, 0, true}, // End past the last byte
+		{"bytes 5-4/10", 0, 0, 0, true},
+		{"bytes -1-4/10", 0, 0, 0, true},
+		{"bytes 0-0/0", 0, 0, 0, true},
+		{"bytes 0-9/*", 0, 0, 0, true},
+		{"bytes */10", 0, 0, 0, true},
+		{"0-9/10", 0, 0, 0, true},
+		{"", 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, end, total, err := parseContentRange(tt.header)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseContentRange(%q) error = %v, want error %v", tt.header, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (start != tt.start || end != tt.end || total != tt.total) {
+			t.Errorf("parseContentRange(%q) = %d-%d/%d, want %d-%d/%d", tt.header, start, end, total, tt.start, tt.end, tt.total)
+		}
+	}
+}
+
+func TestChunkedUploadAddRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    int64
+		ranges   [][2]int64
+		want     [][2]int64
+		complete bool
+	}{
+		{"single chunk", 10, [][2]int64{{0, 9}}, [][2]int64{{0, 9}}, true},
+		{"adjacent in order", 10, [][2]int64{{0, 4}, {5, 9}}, [][2]int64{{0, 9}}, true},
+		{"adjacent out of order", 10, [][2]int64{{5, 9}, {0, 4}}, [][2]int64{{0, 9}}, true},
+		{"overlapping", 10, [][2]int64{{0, 6}, {3, 9}}, [][2]int64{{0, 9}}, true},
+		{"contained", 10, [][2]int64{{0, 9}, {2, 3}}, [][2]int64{{0, 9}}, true},
+		{"repeated chunk", 10, [][2]int64{{0, 4}, {0, 4}}, [][2]int64{{0, 4}}, false},
+		{"gap", 10, [][2]int64{{0, 3}, {5, 9}}, [][2]int64{{0, 3}, {5, 9}}, false},
+		{"gap filled", 10, [][2]int64{{0, 3}, {6, 9}, {4, 5}}, [][2]int64{{0, 9}}, true},
+		{"bridging overlap", 20, [][2]int64{{0, 4}, {10, 14}, {3, 11}}, [][2]int64{{0, 14}}, false},
+		{"missing start", 10, [][2]int64{{1, 9}}, [][2]int64{{1, 9}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &chunkedUpload{total: tt.total}
+			for _, rg := range tt.ranges {
+				u.addRange(rg[0], rg[1])
+			}
+			if !slices.Equal(u.received, tt.want) {
+				t.Errorf("received = %v, want %v", u.received, tt.want)
+			}
+			if u.complete() != tt.complete {
+				t.Errorf("complete = %t, want %t", u.complete(), tt.complete)
+			}
+		})
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	defer func(timeout time.Duration) { cfg.RequestTimeout = timeout }(cfg.RequestTimeout)
+	cfg.RequestTimeout = 20 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		body    string
+	}{
+		{
+			name: "done in time",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Handler", "yes")
+				io.WriteString(w, "ok")
+			},
+			status: http.StatusOK,
+			body:   "ok",
+		},
+		{
+			name: "no write before the deadline",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Handler", "yes")
+				<-r.Context().Done()
+				// Wait for the timeout to answer; a write racing it could still start the response
+				tw := w.(*timeoutWriter)
+				for timedOut := false; !timedOut; time.Sleep(time.Millisecond) {
+					tw.mu.Lock()
+					timedOut = tw.timedOut
+					tw.mu.Unlock()
+				}
+				if _, err := io.WriteString(w, "late"); err != http.ErrHandlerTimeout {
+					t.Errorf("write after the timeout returned %v, want http.ErrHandlerTimeout", err)
+				}
+			},
+			status: http.StatusServiceUnavailable,
+			body:   "Request timed out, please try again\n",
+		},
+		{
+			name: "streaming past the deadline",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Handler", "yes")
+				io.WriteString(w, "first ")
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				io.WriteString(w, "second")
+			},
+			status: http.StatusOK,
+			body:   "first second",
+		},
+		{
+			name: "status written before the deadline",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Handler", "yes")
+				w.WriteHeader(http.StatusAccepted)
+				<-r.Context().Done()
+				io.WriteString(w, "late")
+			},
+			status: http.StatusAccepted,
+			body:   "late",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			timeoutMiddleware(tt.handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/projects", nil))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body, tt.body)
+			}
+			if handlerHeader := rec.Header().Get("X-Handler") != ""; handlerHeader != (tt.status != http.StatusServiceUnavailable) {
+				t.Errorf("handler header sent = %t on a %d response", handlerHeader, rec.Code)
+			}
+		})
+	}
+}
@@ -3,7 +3,8 @@ import * as svg from './svg.js';
 /**
  * @typedef {Object} stored_image
  * @property {string} name - The name of the image
- * @property {Blob} blob - The image data as a Blob
+ * @property {Blob} [blob] - The image data as a Blob
+ * @property {string} [url] - Address of an externally hosted image, set instead of blob
  */
 
 // Shim functions if script.js is loaded later or handles them differently
@@ -91,7 +92,7 @@ async function perform_transaction(mode, operation) {
  */
 export async function store_image(image) {
     // Basic validation
-    if (!image || !image.name || !(image.blob instanceof Blob)) {
+    if (!image || !image.name || !(image.blob instanceof Blob || typeof image.url === 'string')) {
         return Promise.reject(new Error("Invalid image data provided to store_image."));
     }
     try {
@@ -325,7 +326,17 @@ document.getElementById('image_select')?.addEventListener('change', async (event
         const stored_image = await get_image(image_name);
         image_container.innerHTML = ''; // Clear previous image
 
-        if (stored_image && stored_image.blob) {
+        if (stored_image && stored_image.url) {
+            const img = document.createElement('img');
+            img.src = stored_image.url;
+            img.alt = stored_image.name;
+            img.style.maxWidth = '300px';
+            img.style.display = 'block';
+            img.onerror = () => {
+                image_container.textContent = 'Error loading image preview.';
+            }
+            image_container.appendChild(img);
+        } else if (stored_image && stored_image.blob) {
             // It's generally better to revoke previous URLs to avoid memory leaks
             const old_img = image_container.querySelector('img');
             if (old_img && old_img.src.startsWith('blob:')) {
@@ -417,14 +428,14 @@ document.getElementById('rename_form')?.addEventListener('submit', async (event)
 
     try {
         const existing_image = await get_image(old_name);
-        if (!existing_image || !existing_image.blob) {
+        if (!existing_image || !(existing_image.blob || existing_image.url)) {
             showError(`Original image "${old_name}" not found.`);
             await populate_image_select(); // Refresh list in case it was deleted elsewhere
             return;
         }
 
         // Store with new name, then delete old one
-        await store_image({ name: new_name, blob: existing_image.blob });
+        await store_image({ ...existing_image, name: new_name });
         await delete_image(old_name); // This also clears caches for old_name
 
         await populate_image_select(); // Refresh dropdown
@@ -0,0 +1,17 @@
+// Renders a project body on /embed/{token} pages using the same pipeline as the editor preview
+import * as svg from './svg.js';
+import * as tokenizer from './tokenizer.js';
+
+const body = JSON.parse(document.getElementById('underlog-body').textContent);
+const result = document.getElementById('result');
+
+try {
+    const tokens = tokenizer.tokenizeReport(body);
+    const pages = (await svg.parse(tokens)).map(rs => svg.evaluate(rs));
+    result.innerHTML = pages
+        .filter(page => typeof page === 'string' && page.trim().startsWith('<svg'))
+        .join('\n');
+} catch (error) {
+    console.error("Error rendering embedded project:", error);
+    result.textContent = 'Failed to render this project.';
+}
@@ -170,7 +170,7 @@ export async function export_svg() {
 }
 
 export async function export_pdf() {
-    const pdf_endpoint = '/pdf';
+    const pdf_endpoint = 'pdf'; // Relative to the page, like the API calls in script.js
 
     try {
         const final_svg = await get_final_svg();
@@ -208,7 +208,7 @@ export async function export_pdf() {
 export async function export_odt() {
     console.error("TODO: implement ODT");
     return;
-    // const odt_endpoint = '/odt';
+    // const odt_endpoint = 'odt';
     //
     // try {
     //     const final_svg = await get_final_svg();
@@ -78,6 +78,8 @@ jar.onUpdate(code => {
 jar.updateCode(window.editor_content); // Initially empty
 
 // --- API Helper ---
+// URLs have no leading slash so they resolve against the page, which keeps the client working
+// when the server runs under UNDERLOG_BASE_PATH
 async function apiFetch(url, options = {}) {
     const defaultOptions = {
         method: 'GET',
@@ -141,7 +143,7 @@ async function handleLogin(event) {
         return;
     }
     try {
-        await apiFetch('/login', {
+        await apiFetch('login', {
             method: 'POST',
             body: { username, password },
         });
@@ -175,7 +177,7 @@ async function handleRegister(event) {
         return;
     }
     try {
-        await apiFetch('/register', {
+        await apiFetch('register', {
             method: 'POST',
             body: { username, password },
         });
@@ -195,7 +197,7 @@ async function handleRegister(event) {
 
 async function handleLogout() {
     try {
-        await apiFetch('/logout', { method: 'POST' });
+        await apiFetch('logout', { method: 'POST' });
         isLoggedIn = false;
         currentProjectId = null;
         currentProjectName = '';
@@ -230,7 +232,7 @@ async function checkLoginStatus() {
     try {
         // Attempt to fetch projects. If successful, user is logged in.
         // We don't need the project data here, just the success/failure.
-        await apiFetch('/api/projects'); // Uses GET by default
+        await apiFetch('api/projects'); // Uses GET by default
         isLoggedIn = true;
         // Need to know the username - could add a dedicated '/api/userinfo' endpoint
         // or fetch projects and infer from potential ownership (less ideal)
@@ -267,7 +269,7 @@ function resetEditorAndDb() {
 async function fetchAndDisplayProjects() {
     if (!isLoggedIn) return;
     try {
-        const projects = await apiFetch('/api/projects');
+        const projects = await apiFetch('api/projects');
         displayProjectList(projects || []);
     } catch (error) {
         showError(`Failed to fetch projects: ${error.message}`);
@@ -314,7 +316,7 @@ async function loadProject(projectId) {
     showFeedback("Loading project..."); // Show loading indicator
     try {
         // 1. Fetch project details (name, body, image names)
-        const projectData = await apiFetch(`/api/projects/${projectId}`);
+        const projectData = await apiFetch(`api/projects/${projectId}`);
         if (!projectData) throw new Error("Project data not received.");
 
         currentProjectId = projectId;
@@ -326,9 +328,17 @@ async function loadProject(projectId) {
 
         // 3. Fetch and store images
         if (projectData.image_names && projectData.image_names.length > 0) {
+            const imageUrls = projectData.image_urls || {};
             const imagePromises = projectData.image_names.map(async (imageName) => {
                 try {
-                    const response = await fetch(`/api/projects/${projectId}/image/${encodeURIComponent(imageName)}`);
+                    // External images are kept as references; fetching them would follow a
+                    // cross-origin redirect and the next save would upload the bytes instead
+                    if (imageUrls[imageName]) {
+                        await db.store_image({ name: imageName, url: imageUrls[imageName] });
+                        console.info(`Stored external image reference: ${imageName}`);
+                        return;
+                    }
+                    const response = await fetch(`api/projects/${projectId}/image/${encodeURIComponent(imageName)}`);
                     if (!response.ok) {
                         throw new Error(`Failed to fetch image ${imageName}: ${response.statusText}`);
                     }
@@ -385,6 +395,10 @@ async function saveProject() {
         const imagesPayload = [];
         const conversionPromises = localImages.map(async (img) => {
             try {
+                if (img.url) {
+                    imagesPayload.push({ name: img.name, url: img.url });
+                    return;
+                }
                 const base64 = await db.blobToBase64(img.blob);
                 imagesPayload.push({ name: img.name, blob_base64: base64 });
             } catch (conversionError) {
@@ -403,7 +417,7 @@ async function saveProject() {
             images: imagesPayload,
         };
 
-        await apiFetch(`/api/projects/${currentProjectId}`, {
+        await apiFetch(`api/projects/${currentProjectId}`, {
             method: 'PUT',
             body: payload,
         });
@@ -434,11 +448,11 @@ async function handleNewProject() {
     showFeedback("Creating new project...");
 
     try {
-        const newProject = await apiFetch('/api/projects', {
+        const newProject = await apiFetch('api/projects', {
             method: 'POST',
             body: {
                 name: projectName,
-                body: "...", // Start with default content?
+                body: "", // The server fills in its default template
             },
         });
 
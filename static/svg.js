@@ -158,7 +158,7 @@ export async function get_image_height(name) {
         try {
             const stored_image = await db.get_image(name);
 
-            if (!stored_image || !stored_image.blob) {
+            if (!stored_image || !(stored_image.blob || stored_image.url)) {
                 // Image not found in DB is not necessarily an *error*, but results in 0 dimensions
                 //console.warn(`Image "${name}" not found in DB or has no blob.`);
                 resolve(null); // Resolve with zero-dimensions
@@ -171,7 +171,8 @@ export async function get_image_height(name) {
                 // console.log(`Revoked old blob URL for ${name}`);
             }
 
-            blob_url = URL.createObjectURL(stored_image.blob);
+            // Externally hosted images are referenced by their URL, there is no blob to wrap
+            blob_url = stored_image.url || URL.createObjectURL(stored_image.blob);
             IMAGE_URL_CACHE[name] = blob_url; // Cache the new URL immediately
 
             const img = new Image();